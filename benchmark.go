@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eqld/carrot/client"
+)
+
+// runBenchmark sends alternating set and get commands over concurrent
+// connections and reports the throughput and latency percentiles.
+func runBenchmark() {
+	clients, requests := *benchmarkClients, *benchmarkRequests
+	if clients <= 0 || requests <= 0 || *benchmarkValueSize < 0 {
+		log.Println("-benchmark-clients and -benchmark-requests must be positive, -benchmark-value-size can't be negative")
+		return
+	}
+	if clients > requests {
+		clients = requests
+	}
+
+	address := addresses.values[0]
+	log.Printf("benchmarking %s with %d requests over %d connections\n", address, requests, clients)
+
+	conns := make([]*client.Client, clients)
+	for i := range conns {
+		c, err := client.Dial(address)
+		if err != nil {
+			log.Printf("failed to connect: %v\n", err)
+			return
+		}
+		defer c.Close()
+
+		conns[i] = c
+	}
+
+	value := strings.Repeat("x", *benchmarkValueSize)
+	latencies := make([][]time.Duration, clients)
+	failures := make([]error, clients)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for i, c := range conns {
+		// the first connections take the remainder of the requests
+		n := requests / clients
+		if i < requests%clients {
+			n++
+		}
+
+		wg.Add(1)
+		go func(i, n int, c *client.Client) {
+			defer wg.Done()
+
+			latencies[i] = make([]time.Duration, 0, n)
+
+			for j := 0; j < n; j++ {
+				key := fmt.Sprintf("benchmark:%d:%d", i, j/2)
+
+				sent := time.Now()
+
+				var err error
+				if j%2 == 0 {
+					_, err = c.Call("set", key, value)
+				} else {
+					_, err = c.Call("get", key)
+				}
+				if err != nil {
+					failures[i] = err
+					return
+				}
+
+				latencies[i] = append(latencies[i], time.Since(sent))
+			}
+		}(i, n, c)
+	}
+
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var all []time.Duration
+	for i := range latencies {
+		if failures[i] != nil {
+			log.Printf("connection %d failed: %v\n", i, failures[i])
+		}
+		all = append(all, latencies[i]...)
+	}
+	if len(all) == 0 {
+		return
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	percentile := func(p float64) time.Duration {
+		return all[int(p*float64(len(all)-1))]
+	}
+
+	fmt.Printf("requests:   %d in %v\n", len(all), elapsed.Round(time.Millisecond))
+	fmt.Printf("throughput: %.0f requests/s\n", float64(len(all))/elapsed.Seconds())
+	fmt.Printf("latency:    p50 %v, p90 %v, p99 %v, max %v\n", percentile(0.5), percentile(0.9), percentile(0.99), all[len(all)-1])
+}
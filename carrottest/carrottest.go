@@ -0,0 +1,44 @@
+// Package carrottest runs carrot servers in-process for tests, the way
+// net/http/httptest runs HTTP servers.
+package carrottest
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/eqld/carrot/server"
+)
+
+// NewServer starts a server configured by the options, with a Store of its
+// own, listening on a free port of the loopback interface. It returns the
+// address to connect to, as passed to client.Dial, along with a function
+// which shuts the server down and waits for it. NewServer panics if the
+// server can't be started.
+func NewServer(opts server.Options) (address string, cleanup func()) {
+	srv, err := server.New(opts)
+	if err != nil {
+		panic(fmt.Sprintf("carrottest: failed to create the server: %v", err))
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		srv.Close()
+		panic(fmt.Sprintf("carrottest: failed to listen on a port: %v", err))
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		srv.Serve(listener)
+	}()
+
+	cleanup = func() {
+		srv.Close()
+		// the server may be closed before it started serving the listener,
+		// which it then leaves open
+		listener.Close()
+		<-done
+	}
+
+	return listener.Addr().String(), cleanup
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+// arity is the range of the number of arguments a command accepts, max is -1
+// if there is no upper bound.
+type arity struct {
+	min int
+	max int
+}
+
+// arities of the known commands. Arguments are counted as space-separated
+// words, so the commands whose last argument takes the rest of the line over
+// the line protocol, such as a value or a key that may contain spaces, have no
+// upper bound.
+var arities = map[string]arity{
+	"ping":          {0, 0},
+	"command":       {0, 2},
+	"quit":          {0, 0},
+	"auth":          {2, 2},
+	"consistency":   {0, 0},
+	"info":          {0, 0},
+	"version":       {0, 0},
+	"timing":        {1, 1},
+	"changes":       {1, 1},
+	"multibulk":     {1, 1},
+	"noreply":       {1, -1},
+	"client":        {1, 2},
+	"namespace":     {1, -1},
+	"set":           {2, -1},
+	"deltag":        {1, 1},
+	"delpattern":    {1, -1},
+	"expiretag":     {2, 2},
+	"dryrun":        {2, 2},
+	"setne":         {2, -1},
+	"get":           {1, -1},
+	"getcrc":        {1, -1},
+	"getrange":      {3, 3},
+	"substr":        {3, 3},
+	"getdefault":    {2, -1},
+	"scanvalues":    {2, 2},
+	"mttl":          {1, -1},
+	"getsetex":      {3, 3},
+	"del":           {1, -1},
+	"unlink":        {1, -1},
+	"renamenx":      {2, 2},
+	"zadd":          {3, -1},
+	"zscore":        {2, -1},
+	"zrange":        {3, 4},
+	"zrangebyscore": {3, 6},
+	"setbit":        {3, 3},
+	"getbit":        {2, 2},
+	"bitcount":      {1, 3},
+	"pfadd":         {2, -1},
+	"pfcount":       {1, -1},
+	"pfmerge":       {2, -1},
+	"memory":        {2, -1},
+	"object":        {1, -1},
+	"eval":          {4, -1},
+	"incrwithttl":   {2, 2},
+	"incrcap":       {2, 2},
+	"dump":          {1, -1},
+	"restore":       {3, 3},
+	"debug":         {2, -1},
+}
+
+// Arity returns the range of the number of arguments CheckCommand lets
+// through for the command, max being -1 if there is no upper bound. ok is
+// false if the command isn't known.
+func Arity(command string) (min, max int, ok bool) {
+	a, ok := arities[command]
+	return a.min, a.max, ok
+}
+
+// CheckCommand checks the number of arguments of the command line if the
+// command is known. Unknown commands are let through, so that commands added
+// to the server are usable before the client learns about them.
+func CheckCommand(line string) error {
+	return checkArgs(strings.Fields(line))
+}
+
+// checkArgs checks the number of arguments of the command, fields holding the
+// command name followed by its arguments.
+func checkArgs(fields []string) error {
+	if len(fields) == 0 {
+		return fmt.Errorf("empty command")
+	}
+
+	a, ok := arities[fields[0]]
+	if !ok {
+		return nil
+	}
+	if fields[0] == "noreply" && len(fields) > 1 {
+		return checkArgs(fields[1:])
+	}
+
+	n := len(fields) - 1
+	switch {
+	case n < a.min:
+		return fmt.Errorf("'%s' needs at least %d arguments, got %d", fields[0], a.min, n)
+	case a.max >= 0 && n > a.max:
+		return fmt.Errorf("'%s' accepts at most %d arguments, got %d", fields[0], a.max, n)
+	}
+
+	return nil
+}
@@ -0,0 +1,549 @@
+// Package client implements a client of the carrot server.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Client is a connection to a carrot server. A Client is not safe for
+// concurrent use, except that Send and Receive may be called concurrently with
+// each other, so that one goroutine sends requests while another reads their
+// responses.
+type Client struct {
+	// CheckCommands makes Do check the arguments of known commands with
+	// CheckCommand before sending them, failing without a round trip.
+	CheckCommands bool
+
+	conn    net.Conn
+	reader  *bufio.Reader
+	version byte
+	// timing is set once the server has been told to report processing
+	// times, timed reports whether the last response carried one and
+	// serverTime holds it
+	timing     bool
+	timed      bool
+	serverTime time.Duration
+	// multi reports whether the last response was a multi-bulk response,
+	// elements holding its elements
+	multi    bool
+	elements []string
+	// nextID is the request ID used by Call over the tagged protocol, and
+	// timingRequests holds the words of the outstanding timing commands
+	// sent with Send, so that Receive can follow the timing setting
+	nextID         uint32
+	mu             sync.Mutex
+	timingRequests map[uint32][]string
+}
+
+// protocol versions, see the server for their description
+const (
+	handshakeMarker = 0x00
+	multiBulkMarker = math.MaxUint32
+	closeMarker     = math.MaxUint32 - 1
+
+	protocolLine   = 1
+	protocolFramed = 2
+	protocolTagged = 3
+)
+
+// ClosedError is returned when the server closed the connection on its own,
+// such as when the connection was idle for too long or when the server shuts
+// down, and told why. The server only tells why over the framed and tagged
+// protocols.
+type ClosedError struct {
+	Reason string
+}
+
+func (e *ClosedError) Error() string {
+	return "connection closed by the server: " + e.Reason
+}
+
+// Dial connects to the carrot server at the address, speaking the line
+// protocol. The address is either a TCP host and port or 'unix:' followed by
+// the path of a Unix socket.
+func Dial(address string) (*Client, error) {
+	network := "tcp"
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		network, address = "unix", path
+	}
+
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		version: protocolLine,
+	}, nil
+}
+
+// DialFramed connects to the carrot server at the address and negotiates the
+// framed protocol, in which the arguments passed to Call may hold any bytes.
+func DialFramed(address string) (*Client, error) {
+	return dialVersion(address, protocolFramed, "framed")
+}
+
+// DialTagged connects to the carrot server at the address and negotiates the
+// tagged protocol, which extends the framed protocol with request IDs, so that
+// many requests sent with Send may be outstanding while their responses are
+// read with Receive.
+func DialTagged(address string) (*Client, error) {
+	c, err := dialVersion(address, protocolTagged, "tagged")
+	if err != nil {
+		return nil, err
+	}
+
+	c.timingRequests = make(map[uint32][]string)
+
+	return c, nil
+}
+
+// dialVersion connects to the carrot server at the address and negotiates the
+// protocol version, named after the protocol in errors.
+func dialVersion(address string, version byte, name string) (*Client, error) {
+	c, err := Dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.conn.Write([]byte{handshakeMarker, version}); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+
+	offered, err := c.reader.ReadByte()
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	if offered < version {
+		c.conn.Close()
+		return nil, fmt.Errorf("server doesn't support the %s protocol, it offered version %d", name, offered)
+	}
+
+	c.version = offered
+
+	return c, nil
+}
+
+// Do sends the command line to the server and returns its response. Do is
+// only supported over the line protocol. A command line starting with
+// noreply gets no response, Do returns an empty one without waiting.
+func (c *Client) Do(command string) (string, error) {
+	if c.version != protocolLine {
+		return "", fmt.Errorf("command lines are only supported over the line protocol, use Call instead")
+	}
+
+	if c.CheckCommands {
+		if err := CheckCommand(command); err != nil {
+			return "", err
+		}
+	}
+
+	if !strings.HasSuffix(command, "\n") {
+		command += "\n"
+	}
+
+	if _, err := io.WriteString(c.conn, command); err != nil {
+		return "", err
+	}
+
+	words := strings.Fields(command)
+	if len(words) > 0 && words[0] == "noreply" {
+		return "", nil
+	}
+
+	return c.receive(words)
+}
+
+// Call sends the command with its arguments to the server and returns its
+// response. Over the line protocol the arguments are joined with spaces, so
+// only the last one may contain spaces and none may contain newlines, use a
+// client created by DialFramed to send arbitrary arguments. Over the tagged
+// protocol, Call fails if the response it reads isn't the one to its command,
+// which happens when requests sent with Send are outstanding. A noreply
+// command is sent with SendNoReply, Call returning an empty response without
+// waiting.
+func (c *Client) Call(command string, args ...string) (string, error) {
+	if command == "noreply" {
+		if len(args) == 0 {
+			return "", fmt.Errorf("noreply needs a command to send")
+		}
+
+		return "", c.SendNoReply(args[0], args[1:]...)
+	}
+
+	if c.version >= protocolTagged {
+		id := c.nextID
+		c.nextID++
+
+		if err := c.Send(id, command, args...); err != nil {
+			return "", err
+		}
+
+		respID, response, err := c.Receive()
+		if err != nil {
+			return "", err
+		}
+		if respID != id {
+			return "", fmt.Errorf("received the response to request %d while waiting for request %d", respID, id)
+		}
+
+		return response, nil
+	}
+
+	words := append([]string{command}, args...)
+
+	if c.CheckCommands {
+		if err := checkArgs(words); err != nil {
+			return "", err
+		}
+	}
+
+	if c.version < protocolFramed {
+		line := strings.Join(words, " ")
+		if strings.ContainsAny(line, "\r\n") {
+			return "", fmt.Errorf("arguments can't contain newlines over the line protocol")
+		}
+
+		return c.Do(line)
+	}
+
+	if _, err := c.conn.Write(appendFrame(nil, words)); err != nil {
+		return "", err
+	}
+
+	return c.receive(words)
+}
+
+// Send sends the command with its arguments to the server along with the
+// request ID, without waiting for the response. The response is read by
+// Receive, tagged with the same ID. Send is only supported over the tagged
+// protocol.
+func (c *Client) Send(id uint32, command string, args ...string) error {
+	if c.version < protocolTagged {
+		return fmt.Errorf("request IDs are only supported over the tagged protocol, use Call instead")
+	}
+	if command == "noreply" {
+		return fmt.Errorf("noreply commands get no response to match by ID, use SendNoReply instead")
+	}
+
+	words := append([]string{command}, args...)
+
+	if c.CheckCommands {
+		if err := checkArgs(words); err != nil {
+			return err
+		}
+	}
+
+	// the command is registered before being sent, as its response may be
+	// received right away
+	if command == "timing" {
+		c.mu.Lock()
+		c.timingRequests[id] = words
+		c.mu.Unlock()
+	}
+
+	frame := binary.LittleEndian.AppendUint32(nil, id)
+	_, err := c.conn.Write(appendFrame(frame, words))
+
+	return err
+}
+
+// SendNoReply sends the command with its arguments to the server prefixed with
+// noreply, so that the server handles it without sending any response, not
+// even an error. Arguments are sent as by Call.
+func (c *Client) SendNoReply(command string, args ...string) error {
+	words := append([]string{"noreply", command}, args...)
+
+	if c.CheckCommands {
+		if err := checkArgs(words); err != nil {
+			return err
+		}
+	}
+
+	var frame []byte
+	switch {
+	case c.version < protocolFramed:
+		line := strings.Join(words, " ")
+		if strings.ContainsAny(line, "\r\n") {
+			return fmt.Errorf("arguments can't contain newlines over the line protocol")
+		}
+		frame = []byte(line + "\n")
+	case c.version < protocolTagged:
+		frame = appendFrame(nil, words)
+	default:
+		// the request ID is never echoed, it only keeps the frame well formed
+		frame = appendFrame(binary.LittleEndian.AppendUint32(nil, c.nextID), words)
+		c.nextID++
+	}
+
+	_, err := c.conn.Write(frame)
+
+	return err
+}
+
+// Receive reads the next response sent over the tagged protocol and returns it
+// along with the ID of the request it answers.
+func (c *Client) Receive() (id uint32, response string, err error) {
+	if c.version < protocolTagged {
+		return 0, "", fmt.Errorf("request IDs are only supported over the tagged protocol, use Call instead")
+	}
+
+	id, message, err := c.receiveTagged()
+
+	return id, string(message), err
+}
+
+// receiveTagged reads the next response sent over the tagged protocol along
+// with the ID of the request it answers.
+func (c *Client) receiveTagged() (uint32, []byte, error) {
+	idBytes := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, idBytes); err != nil {
+		return 0, nil, err
+	}
+	id := binary.LittleEndian.Uint32(idBytes)
+
+	c.mu.Lock()
+	words := c.timingRequests[id]
+	delete(c.timingRequests, id)
+	c.mu.Unlock()
+
+	message, err := c.receiveBytes(words)
+
+	return id, message, err
+}
+
+// SetBytes stores the value under the key like the set command does. The value
+// is sent as is, without being converted to a string. SetBytes is only
+// supported over the framed and tagged protocols.
+func (c *Client) SetBytes(key string, value []byte) error {
+	response, err := c.callBytes([]string{"set", key}, value)
+	if err != nil {
+		return err
+	}
+
+	// changes mode replies whether the value changed rather than ok
+	switch string(response) {
+	case "ok", "0", "1":
+		return nil
+	default:
+		return errors.New(string(response))
+	}
+}
+
+// GetBytes returns the value stored under the key like the get command does,
+// ok reporting whether the key was found. The value is returned as received,
+// without being converted to a string. GetBytes is only supported over the
+// framed and tagged protocols.
+func (c *Client) GetBytes(key string) (value []byte, ok bool, err error) {
+	response, err := c.callBytes([]string{"get"}, []byte(key))
+	if err != nil {
+		return nil, false, err
+	}
+
+	if value, ok := bytes.CutPrefix(response, []byte("found: ")); ok {
+		return value, true, nil
+	}
+	if string(response) == "not found" {
+		return nil, false, nil
+	}
+
+	return nil, false, errors.New(string(response))
+}
+
+// callBytes sends the command made of the words followed by the last word,
+// which is written straight from the slice rather than copied, and returns the
+// response as bytes.
+func (c *Client) callBytes(words []string, last []byte) ([]byte, error) {
+	if c.version < protocolFramed {
+		return nil, fmt.Errorf("byte values are only supported over the framed protocol, use DialFramed instead")
+	}
+
+	id := c.nextID
+	var header []byte
+	if c.version >= protocolTagged {
+		c.nextID++
+		header = binary.LittleEndian.AppendUint32(header, id)
+	}
+
+	// frame the words along with the count and size of the last one, which
+	// follows them
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(words)+1))
+	for _, word := range words {
+		header = binary.LittleEndian.AppendUint32(header, uint32(len(word)))
+		header = append(header, word...)
+	}
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(last)))
+
+	buffers := net.Buffers{header, last}
+	if _, err := buffers.WriteTo(c.conn); err != nil {
+		return nil, err
+	}
+
+	if c.version < protocolTagged {
+		return c.receiveBytes(words)
+	}
+
+	respID, message, err := c.receiveTagged()
+	if err != nil {
+		return nil, err
+	}
+	if respID != id {
+		return nil, fmt.Errorf("received the response to request %d while waiting for request %d", respID, id)
+	}
+
+	return message, nil
+}
+
+// appendFrame appends the words framed as their number followed by every word
+// framed as its length, all numbers being 4 little-endian bytes.
+func appendFrame(frame []byte, words []string) []byte {
+	frame = binary.LittleEndian.AppendUint32(frame, uint32(len(words)))
+	for _, word := range words {
+		frame = binary.LittleEndian.AppendUint32(frame, uint32(len(word)))
+		frame = append(frame, word...)
+	}
+
+	return frame
+}
+
+// CallMulti sends the command with its arguments like Call does, and returns
+// the elements of its multi-bulk response. Servers send multi-bulk responses
+// over the framed and tagged protocols once sent 'multibulk on', to commands
+// replying several elements. A single response, such as an error or 'not
+// found', makes CallMulti fail with an error holding the response.
+func (c *Client) CallMulti(command string, args ...string) ([]string, error) {
+	message, err := c.Call(command, args...)
+	if err != nil {
+		return nil, err
+	}
+	if !c.multi {
+		return nil, errors.New(message)
+	}
+
+	return c.elements, nil
+}
+
+// ServerTime returns the time the server spent processing the command of the
+// last response, ok reports whether the response carried it. Servers report
+// processing times once sent 'timing on'.
+func (c *Client) ServerTime() (elapsed time.Duration, ok bool) {
+	return c.serverTime, c.timed
+}
+
+// receive reads the response to the command made of the words, framed as its
+// length in 4 little-endian bytes followed by the response itself and, if
+// timing is enabled, by the processing time. The elements of a multi-bulk
+// response are joined with newlines, as the server would have without
+// multi-bulk responses. The message the server sends before closing the
+// connection on its own makes it fail with a ClosedError.
+func (c *Client) receive(words []string) (string, error) {
+	message, err := c.receiveBytes(words)
+
+	return string(message), err
+}
+
+// receiveBytes reads the response to the command made of the words like
+// receive does, and returns it as bytes.
+func (c *Client) receiveBytes(words []string) ([]byte, error) {
+	sizeBytes := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, sizeBytes); err != nil {
+		return nil, err
+	}
+
+	var message []byte
+	c.multi, c.elements = false, nil
+	switch size := binary.LittleEndian.Uint32(sizeBytes); size {
+	case closeMarker:
+		if _, err := io.ReadFull(c.reader, sizeBytes); err != nil {
+			return nil, err
+		}
+		reason := make([]byte, binary.LittleEndian.Uint32(sizeBytes))
+		if _, err := io.ReadFull(c.reader, reason); err != nil {
+			return nil, err
+		}
+
+		return nil, &ClosedError{Reason: string(reason)}
+	case multiBulkMarker:
+		elements, err := c.receiveElements()
+		if err != nil {
+			return nil, err
+		}
+		c.multi, c.elements = true, elements
+		message = []byte(strings.Join(elements, "\n"))
+	default:
+		message = make([]byte, size)
+		if _, err := io.ReadFull(c.reader, message); err != nil {
+			return nil, err
+		}
+	}
+
+	c.timed, c.serverTime = c.timing, 0
+	if c.timing {
+		elapsedBytes := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, elapsedBytes); err != nil {
+			return nil, err
+		}
+		c.serverTime = time.Duration(binary.LittleEndian.Uint64(elapsedBytes)) * time.Microsecond
+	}
+
+	// follow the timing setting so that the following responses are read
+	// in the right format
+	if len(words) == 2 && words[0] == "timing" && string(message) == "ok" {
+		c.timing = words[1] == "on"
+	}
+
+	return message, nil
+}
+
+// receiveElements reads the elements of a multi-bulk response, framed as
+// their number followed by every element framed as its length.
+func (c *Client) receiveElements() ([]string, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, b); err != nil {
+		return nil, err
+	}
+
+	count := binary.LittleEndian.Uint32(b)
+	elements := make([]string, 0, min(count, 1024))
+	for i := uint32(0); i < count; i++ {
+		if _, err := io.ReadFull(c.reader, b); err != nil {
+			return nil, err
+		}
+
+		element := make([]byte, binary.LittleEndian.Uint32(b))
+		if _, err := io.ReadFull(c.reader, element); err != nil {
+			return nil, err
+		}
+		elements = append(elements, string(element))
+	}
+
+	return elements, nil
+}
+
+// quitTimeout bounds the time Close waits for the server to acknowledge quit,
+// so that an unresponsive server can't block it.
+const quitTimeout = time.Second
+
+// Close ends the session with the quit command and closes the connection.
+func (c *Client) Close() error {
+	// the server closes the connection on quit anyway, so a failure to quit
+	// cleanly doesn't matter
+	c.conn.SetDeadline(time.Now().Add(quitTimeout))
+	c.Call("quit")
+
+	return c.conn.Close()
+}
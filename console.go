@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const (
+	// historyFile is the file in the home directory keeping the command
+	// lines of the interactive client across sessions
+	historyFile = ".carrot_history"
+	// historySize is the number of lines kept in the history
+	historySize = 1000
+)
+
+// console reads the command lines of the interactive client and prints its
+// output. On a terminal, lines can be edited and previous lines recalled with
+// the arrow keys, the history being kept in historyFile. Elsewhere, such as
+// when the input is piped, plain lines are read.
+type console struct {
+	// terminal is nil unless the input is a terminal, reader being used
+	// instead
+	terminal *term.Terminal
+	reader   *bufio.Reader
+	// restore puts the terminal back in the state it was in before the
+	// console took it over
+	restore func()
+}
+
+// newConsole sets the console up on the standard input and output, falling
+// back to plain lines if the terminal can't be switched to raw mode.
+func newConsole() *console {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return &console{reader: bufio.NewReader(os.Stdin)}
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		log.Printf("failed to set up the terminal, line editing is disabled: %v\n", err)
+		return &console{reader: bufio.NewReader(os.Stdin)}
+	}
+
+	terminal := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "> ")
+	history := loadHistory()
+	terminal.History = history
+
+	// in raw mode, line feeds don't return the carriage, which the terminal
+	// adds to what it writes but the log doesn't
+	log.SetOutput(rawWriter{os.Stderr})
+
+	return &console{
+		terminal: terminal,
+		restore: func() {
+			log.SetOutput(os.Stderr)
+			term.Restore(fd, state)
+			if history.file != nil {
+				history.file.Close()
+			}
+		},
+	}
+}
+
+// readLine prompts for the next line and returns it, io.EOF meaning the input
+// is over.
+func (c *console) readLine() (string, error) {
+	if c.terminal != nil {
+		return c.terminal.ReadLine()
+	}
+
+	fmt.Print("> ")
+	return c.reader.ReadString('\n')
+}
+
+// Write prints the output through the terminal if there is one.
+func (c *console) Write(b []byte) (int, error) {
+	if c.terminal != nil {
+		return c.terminal.Write(b)
+	}
+	return os.Stdout.Write(b)
+}
+
+// close gives the terminal back, closing it again doing nothing.
+func (c *console) close() {
+	if c.restore != nil {
+		c.restore()
+		c.restore = nil
+	}
+}
+
+// rawWriter writes to a terminal in raw mode, returning the carriage on line
+// feeds.
+type rawWriter struct {
+	io.Writer
+}
+
+func (w rawWriter) Write(b []byte) (int, error) {
+	if _, err := w.Writer.Write(bytes.ReplaceAll(b, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// history is the history of the lines read by the console, appended to a file
+// as they are read so that they are recalled by the following sessions.
+type history struct {
+	// lines holds the lines from the oldest to the most recent
+	lines []string
+	// file is nil if the history isn't saved
+	file *os.File
+}
+
+// loadHistory reads the lines of the history file, the history only lasting
+// for the session if the file can't be opened.
+func loadHistory() *history {
+	h := &history{}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return h
+	}
+
+	path := filepath.Join(home, historyFile)
+	if b, err := os.ReadFile(path); err == nil {
+		for _, line := range strings.Split(string(b), "\n") {
+			if line != "" {
+				h.lines = append(h.lines, line)
+			}
+		}
+	}
+	if len(h.lines) > historySize {
+		h.lines = h.lines[len(h.lines)-historySize:]
+	}
+
+	// the file is rewritten with the lines kept, so that it doesn't grow
+	// forever
+	if f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600); err == nil {
+		for _, line := range h.lines {
+			fmt.Fprintln(f, line)
+		}
+		h.file = f
+	}
+
+	return h
+}
+
+// Add records the line unless it is empty or repeats the previous one.
+func (h *history) Add(line string) {
+	if strings.TrimSpace(line) == "" || (len(h.lines) > 0 && h.lines[len(h.lines)-1] == line) {
+		return
+	}
+
+	h.lines = append(h.lines, line)
+	if len(h.lines) > historySize {
+		h.lines = h.lines[1:]
+	}
+
+	if h.file != nil {
+		if _, err := fmt.Fprintln(h.file, line); err != nil {
+			h.file = nil
+		}
+	}
+}
+
+func (h *history) Len() int {
+	return len(h.lines)
+}
+
+// At returns the line idx lines before the most recent one.
+func (h *history) At(idx int) string {
+	return h.lines[len(h.lines)-1-idx]
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+)
+
+// serverFlags and clientFlags list the flags applying to the server and the
+// client mode only, the flags listed in neither applying to both.
+var (
+	serverFlags = map[string]bool{
+		"listen-backlog":        true,
+		"tcp-user-timeout":      true,
+		"seed-file":             true,
+		"readiness-address":     true,
+		"max-value-size":        true,
+		"slow-warn-threshold":   true,
+		"checksum":              true,
+		"max-keys":              true,
+		"max-keys-policy":       true,
+		"allow-delpattern":      true,
+		"command-timeout":       true,
+		"background-compaction": true,
+		"max-queue-depth":       true,
+		"acl-file":              true,
+		"read-buffer-size":      true,
+		"value-codec":           true,
+		"debug":                 true,
+	}
+	clientFlags = map[string]bool{
+		"check-commands":       true,
+		"benchmark":            true,
+		"benchmark-requests":   true,
+		"benchmark-clients":    true,
+		"benchmark-value-size": true,
+	}
+)
+
+// validateFlags checks the flags once parsed, so that a misconfiguration is
+// reported on startup rather than when it first matters. It reports flags
+// given twice, flags of the other mode and combinations of flags which
+// conflict or lack the flag they depend on.
+func validateFlags() error {
+	if err := checkRepeatedFlags(os.Args[1 : len(os.Args)-flag.NArg()]); err != nil {
+		return err
+	}
+	if *mode != "server" && *mode != "client" {
+		return nil
+	}
+
+	// flags applying to one mode only are rejected in the other one, as they
+	// would be silently ignored
+	given := make(map[string]bool)
+	var misplaced error
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+
+		wrongMode := serverFlags[f.Name] && *mode != "server" || clientFlags[f.Name] && *mode != "client"
+		if misplaced == nil && wrongMode {
+			misplaced = fmt.Errorf("-%s doesn't apply to the %s mode", f.Name, *mode)
+		}
+	})
+	if misplaced != nil {
+		return misplaced
+	}
+
+	if *mode == "server" {
+		return validateServerFlags(given)
+	}
+
+	return validateClientFlags(given)
+}
+
+// checkRepeatedFlags reports the flags given more than once among the args,
+// which the flag package would let the last one win, except for the flags
+// which may be repeated.
+func checkRepeatedFlags(args []string) error {
+	seen := make(map[string]bool)
+
+	for i := 0; i < len(args); i++ {
+		name, hasValue := strings.CutPrefix(args[i], "-")
+		if !hasValue || name == "-" {
+			continue
+		}
+		name = strings.TrimPrefix(name, "-")
+		name, _, hasValue = strings.Cut(name, "=")
+
+		f := flag.Lookup(name)
+		if f == nil {
+			continue
+		}
+
+		// the value of a flag which isn't boolean is the next arg unless
+		// given after '='
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !hasValue && !(ok && b.IsBoolFlag()) {
+			i++
+		}
+
+		if _, ok := f.Value.(*addressList); ok {
+			continue
+		}
+		if seen[name] {
+			return fmt.Errorf("-%s is given more than once", name)
+		}
+		seen[name] = true
+	}
+
+	return nil
+}
+
+// validateServerFlags checks the values of the flags of the server mode, given
+// holding the flags set on the command line.
+func validateServerFlags(given map[string]bool) error {
+	switch {
+	case *maxValueSize <= 0 || *maxValueSize > math.MaxUint32:
+		return fmt.Errorf("max value size must be between 1 and %d bytes", uint64(math.MaxUint32))
+	case *readBufferSize <= 0:
+		return fmt.Errorf("read buffer size must be positive")
+	case *maxKeys < 0:
+		return fmt.Errorf("max keys must not be negative")
+	case *listenBacklog < 0:
+		return fmt.Errorf("listen backlog must not be negative")
+	case *tcpUserTimeout < 0:
+		return fmt.Errorf("tcp user timeout must not be negative")
+	case *slowWarnThreshold < 0:
+		return fmt.Errorf("slow warn threshold must not be negative")
+	case *commandTimeout < 0:
+		return fmt.Errorf("command timeout must not be negative")
+	case *maxQueueDepth < 0:
+		return fmt.Errorf("max queue depth must not be negative")
+	case given["max-keys-policy"] && *maxKeys == 0:
+		return fmt.Errorf("-max-keys-policy has no effect without -max-keys")
+	}
+
+	if _, ok := maxKeysPolicies[*maxKeysPolicy]; !ok {
+		return fmt.Errorf("unknown max keys policy '%s', expected 'reject' or 'evict'", *maxKeysPolicy)
+	}
+	if _, ok := valueCodecs[*valueCodec]; !ok {
+		return fmt.Errorf("unknown value codec '%s', expected 'gzip', 'base64' or 'none'", *valueCodec)
+	}
+
+	listening := make(map[string]bool)
+	for _, address := range addresses.values {
+		if listening[address] {
+			return fmt.Errorf("address %s is given more than once", address)
+		}
+		listening[address] = true
+	}
+
+	return nil
+}
+
+// validateClientFlags checks the values of the flags of the client mode like
+// validateServerFlags does.
+func validateClientFlags(given map[string]bool) error {
+	switch {
+	case len(addresses.values) > 1:
+		return fmt.Errorf("the client mode connects to a single address, %d are given", len(addresses.values))
+	case *benchmarkRequests <= 0:
+		return fmt.Errorf("benchmark requests must be positive")
+	case *benchmarkClients <= 0:
+		return fmt.Errorf("benchmark clients must be positive")
+	case *benchmarkValueSize < 0:
+		return fmt.Errorf("benchmark value size must not be negative")
+	}
+
+	if !*benchmark {
+		for _, name := range []string{"benchmark-requests", "benchmark-clients", "benchmark-value-size"} {
+			if given[name] {
+				return fmt.Errorf("-%s has no effect without -benchmark", name)
+			}
+		}
+	}
+	if *benchmark && given["check-commands"] {
+		return fmt.Errorf("-check-commands has no effect with -benchmark")
+	}
+
+	return nil
+}
@@ -1,256 +1,318 @@
 package main
 
 import (
-	"bufio"
-	"encoding/binary"
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"math"
-	"net"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+
+	"github.com/eqld/carrot/client"
+	"github.com/eqld/carrot/server"
+	"github.com/eqld/carrot/storage"
 )
 
 var (
+	printVersion = flag.Bool(
+		"version",
+		false,
+		"print the build information and exit",
+	)
 	mode = flag.String(
 		"mode",
 		"",
 		"either 'server' or 'client'",
 	)
-	address = flag.String(
+	addresses = addressFlag(
 		"address",
 		"127.0.0.1:9090",
-		"host and port to listen for connections (server mode) or to connect to (client mode)",
+		"host and port, or 'unix:' followed by a socket path, to listen for connections (server mode, may be repeated) or to connect to (client mode)",
+	)
+	listenBacklog = flag.Int(
+		"listen-backlog",
+		0,
+		"size of the queue of connections waiting to be accepted, system default if 0 (server mode)",
+	)
+	tcpUserTimeout = flag.Duration(
+		"tcp-user-timeout",
+		0,
+		"time transmitted data may stay unacknowledged before a connection is closed, Linux only, disabled if 0 (server mode)",
+	)
+	seedFile = flag.String(
+		"seed-file",
+		"",
+		"file of 'key=value' lines to populate the storage with on startup (server mode)",
+	)
+	readinessAddress = flag.String(
+		"readiness-address",
+		"",
+		"host and port to serve HTTP readiness checks on at /ready, disabled if empty (server mode)",
+	)
+	checkCommands = flag.Bool(
+		"check-commands",
+		false,
+		"check the arguments of known commands before sending them (client mode)",
+	)
+	benchmark = flag.Bool(
+		"benchmark",
+		false,
+		"benchmark the server with set and get commands instead of reading commands from the input (client mode)",
+	)
+	benchmarkRequests = flag.Int(
+		"benchmark-requests",
+		100000,
+		"total number of requests sent by the benchmark (client mode)",
+	)
+	benchmarkClients = flag.Int(
+		"benchmark-clients",
+		50,
+		"number of concurrent connections used by the benchmark (client mode)",
+	)
+	benchmarkValueSize = flag.Int(
+		"benchmark-value-size",
+		64,
+		"size in bytes of the values set by the benchmark (client mode)",
+	)
+	maxValueSize = flag.Int64(
+		"max-value-size",
+		math.MaxUint32,
+		"max length in bytes of the values stored by write commands, at most 4294967295 (server mode)",
+	)
+	slowWarnThreshold = flag.Duration(
+		"slow-warn-threshold",
+		0,
+		"log a warning for every command taking longer than this to handle, disabled if 0 (server mode)",
+	)
+	checksum = flag.Bool(
+		"checksum",
+		false,
+		"keep a CRC32 of every string and verify it on get, reporting corrupt values rather than returning them (server mode)",
+	)
+	maxKeys = flag.Int(
+		"max-keys",
+		0,
+		"max number of keys stored, unlimited if 0 (server mode)",
+	)
+	maxKeysPolicy = flag.String(
+		"max-keys-policy",
+		"reject",
+		"what to do with writes creating keys beyond -max-keys, either 'reject' to fail them or 'evict' to evict approximately least recently used keys (server mode)",
+	)
+	allowDelPattern = flag.Bool(
+		"allow-delpattern",
+		false,
+		"enable the delpattern command, which scans the whole keyspace and may remove many keys at once (server mode)",
+	)
+	commandTimeout = flag.Duration(
+		"command-timeout",
+		0,
+		"max time to wait for commands which may be slow, such as delpattern, before replying 'command timed out', disabled if 0 (server mode)",
+	)
+	backgroundCompaction = flag.Bool(
+		"background-compaction",
+		false,
+		"rebuild the storage maps to reclaim the memory of deleted keys in the background rather than blocking commands meanwhile (server mode)",
+	)
+	maxQueueDepth = flag.Int64(
+		"max-queue-depth",
+		0,
+		"number of commands pending on the storage above which new ones are rejected with 'server overloaded', unlimited if 0 (server mode)",
+	)
+	aclFile = flag.String(
+		"acl-file",
+		"",
+		"path of a file defining the users connections have to authenticate as with 'auth username password', one per line as 'name password commands keys', anyone may run any command if empty (server mode)",
+	)
+	readBufferSize = flag.Int(
+		"read-buffer-size",
+		16<<10,
+		"size in bytes of the buffer commands are read through, larger sizes take fewer reads for large values (server mode)",
+	)
+	valueCodec = flag.String(
+		"value-codec",
+		"none",
+		"codec the strings are stored with, either 'gzip' to compress them, 'base64' or 'none', transparent to clients (server mode)",
+	)
+	debug = flag.Bool(
+		"debug",
+		false,
+		"enable debug commands (server mode)",
 	)
 )
 
 func main() {
 	flag.Parse()
 
+	if *printVersion {
+		fmt.Println(buildInfo())
+		return
+	}
+
+	if err := validateFlags(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid flags: %v\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
 	switch *mode {
 	case "server":
 		runServer()
 	case "client":
-		runClient()
+		if *benchmark {
+			runBenchmark()
+		} else {
+			runClient()
+		}
 	default:
 		log.Printf("unknown mode '%s', valid values are: 'server', 'client'\n", *mode)
 	}
 }
 
-/* server */
-
-type (
-	reqSet struct {
-		key   string
-		value string
-	}
-	reqGet struct {
-		key      string
-		response chan reqGetVal
-	}
-	reqGetVal struct {
-		value string
-		ok    bool
-	}
-	reqDel struct {
-		key string
-	}
-)
-
-func runServer() {
-	log.Printf("listening %s\n", *address)
-
-	listener, err := net.Listen("tcp", *address)
-	if err != nil {
-		panic(err)
-	}
-	defer listener.Close()
-
-	chanSet := make(chan *reqSet)
-	chanGet := make(chan *reqGet)
-	chanDel := make(chan *reqDel)
-	done := make(chan struct{})
-
-	go serveStorage(chanSet, chanGet, chanDel, done)
-	defer close(done)
-
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			panic(err)
-		}
-
-		go handleConn(conn, chanSet, chanGet, chanDel)
-	}
+// addressList is a flag collecting the values of its repetitions.
+type addressList struct {
+	values []string
+	// set reports whether the default value has been replaced
+	set bool
 }
 
-func handleConn(
-	conn net.Conn,
-	chanSet chan<- *reqSet,
-	chanGet chan<- *reqGet,
-	chanDel chan<- *reqDel,
-) {
-	defer conn.Close()
-
-	log.Printf("serving %s\n", conn.RemoteAddr())
-	reader := bufio.NewReader(conn)
-
-	for {
-		line, err := reader.ReadString('\n')
-		if err == io.EOF {
-			log.Printf("disconnecting %s\n", conn.RemoteAddr())
-			return
-		}
-		if err != nil {
-			log.Printf("disconnecting %s due to error: %v\n", conn.RemoteAddr(), err)
-			return
-		}
-
-		line = strings.TrimSpace(line)
-
-		parts := make([]string, 2)
-		copy(parts, strings.SplitN(line, " ", 2))
-		command, data := parts[0], parts[1]
+// addressFlag defines a repeatable flag of addresses, holding the default
+// value unless the flag is given.
+func addressFlag(name, value, usage string) *addressList {
+	l := &addressList{values: []string{value}}
+	flag.Var(l, name, usage)
 
-		message := ""
-
-		switch command {
-		case "set":
-			dataParts := make([]string, 2)
-			copy(dataParts, strings.SplitN(data, " ", 2))
-			key, value := dataParts[0], dataParts[1]
-
-			if len(value) > math.MaxUint32 {
-				message = fmt.Sprintf("value is too long, max allowed length is %d bytes", math.MaxUint32)
-				break
-			}
-
-			chanSet <- &reqSet{key, value}
-
-			message = "ok"
-		case "get":
-			req := &reqGet{
-				key:      data,
-				response: make(chan reqGetVal),
-			}
-
-			chanGet <- req
-			resp := <-req.response
-
-			if resp.ok {
-				message = fmt.Sprintf("found: %s", resp.value)
-			} else {
-				message = "not found"
-			}
-		case "del":
-			chanDel <- &reqDel{data}
-			message = "ok"
-		default:
-			message = fmt.Sprintf("unknown command '%s'", command)
-		}
+	return l
+}
 
-		if err := send(conn, message); err != nil {
-			log.Printf("disconnecting %s due to failure while sending a message: %v\n", conn.RemoteAddr(), err)
-			return
-		}
+func (l *addressList) String() string {
+	if l == nil {
+		return ""
 	}
+	return strings.Join(l.values, ", ")
 }
 
-func serveStorage(
-	chanSet <-chan *reqSet,
-	chanGet <-chan *reqGet,
-	chanDel <-chan *reqDel,
-	done <-chan struct{},
-) {
-	const gcPeriod = 1024
-	var gcCounter = 0
+func (l *addressList) Set(value string) error {
+	if !l.set {
+		l.values, l.set = nil, true
+	}
+	l.values = append(l.values, value)
 
-	storage := make(map[string]string)
+	return nil
+}
 
-	for {
-		select {
-		case req := <-chanSet:
-			storage[req.key] = req.value
-		case req := <-chanGet:
-			resp := reqGetVal{}
-			resp.value, resp.ok = storage[req.key]
-			req.response <- resp
-		case req := <-chanDel:
-			delete(storage, req.key)
-			gcCounter++
-		case <-done:
-			return
-		}
+/* server */
 
-		if gcCounter >= gcPeriod {
-			newStorage := make(map[string]string)
-			for k, v := range storage {
-				newStorage[k] = v
-			}
-			storage = newStorage
-			gcCounter = 0
-		}
-	}
+// maxKeysPolicies maps the values of -max-keys-policy to the policies.
+var maxKeysPolicies = map[string]storage.MaxKeysPolicy{
+	"reject": storage.RejectNewKeys,
+	"evict":  storage.EvictLRU,
 }
 
-func send(conn net.Conn, v string) error {
-	b := []byte(v)
-	l := uint32(len(b))
-	lb := make([]byte, 4)
-	binary.LittleEndian.PutUint32(lb, l)
+// valueCodecs maps the values of -value-codec to the codecs.
+var valueCodecs = map[string]storage.Codec{
+	"none":   nil,
+	"gzip":   storage.GzipCodec{},
+	"base64": storage.Base64Codec{},
+}
 
-	_, err := conn.Write(append(lb, b...))
-	return err
+func runServer() {
+	// the server runs until interrupted, shutting down cleanly then
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// the flags have been validated by validateFlags
+	err := server.Serve(ctx, server.Options{
+		Addresses:        addresses.values,
+		ReadinessAddress: *readinessAddress,
+		Storage: storage.Options{
+			Checksums:            *checksum,
+			MaxKeys:              *maxKeys,
+			MaxKeysPolicy:        maxKeysPolicies[*maxKeysPolicy],
+			BackgroundCompaction: *backgroundCompaction,
+			Codec:                valueCodecs[*valueCodec],
+		},
+		MaxValueSize:      *maxValueSize,
+		ReadBufferSize:    *readBufferSize,
+		ListenBacklog:     *listenBacklog,
+		TCPUserTimeout:    *tcpUserTimeout,
+		SlowWarnThreshold: *slowWarnThreshold,
+		CommandTimeout:    *commandTimeout,
+		MaxQueueDepth:     *maxQueueDepth,
+		ACLFile:           *aclFile,
+		SeedFile:          *seedFile,
+		AllowDelPattern:   *allowDelPattern,
+		Debug:             *debug,
+		BuildInfo:         buildInfo(),
+	})
+	if err != nil {
+		log.Fatalf("server failed: %v\n", err)
+	}
 }
 
 /* client */
 
 func runClient() {
-	log.Printf("connecting to %s\n", *address)
+	address := addresses.values[0]
+	log.Printf("connecting to %s\n", address)
 
-	conn, err := net.Dial("tcp", *address)
+	c, err := client.Dial(address)
 	if err != nil {
-		panic(err)
+		log.Printf("failed to connect: %v\n", err)
+		return
 	}
-	defer conn.Close()
+	defer c.Close()
 
-	reader := bufio.NewReader(os.Stdin)
-	sizeBytes := make([]byte, 4)
-	size := uint32(0)
-	for {
-		fmt.Print("> ")
+	console := newConsole()
+	defer console.close()
 
-		line, err := reader.ReadString('\n')
+	for {
+		line, err := console.readLine()
 		if err == io.EOF {
+			console.close()
 			fmt.Println()
 			log.Println("disconnecting")
 			return
 		}
 		if err != nil {
-			panic(err)
+			log.Printf("failed to read the input: %v\n", err)
+			return
 		}
 
 		if len(strings.TrimSpace(line)) == 0 {
 			continue
 		}
 
-		if _, err = conn.Write([]byte(line)); err != nil {
-			panic(err)
+		if *checkCommands {
+			if err := client.CheckCommand(line); err != nil {
+				fmt.Fprintln(console, "! "+err.Error())
+				continue
+			}
 		}
 
-		if _, err = conn.Read(sizeBytes); err != nil {
-			panic(err)
+		message, err := c.Do(line)
+		if err != nil {
+			log.Printf("connection lost: %v\n", err)
+			return
 		}
 
-		size = binary.LittleEndian.Uint32(sizeBytes)
-		message := make([]byte, int(size))
+		// Do doesn't wait for a response to noreply commands
+		if fields := strings.Fields(line); fields[0] == "noreply" {
+			continue
+		}
 
-		if _, err = conn.Read(message); err != nil {
-			panic(err)
+		if serverTime, ok := c.ServerTime(); ok {
+			fmt.Fprintf(console, "< %s (%v)\n", message, serverTime)
+		} else {
+			fmt.Fprintln(console, "< "+message)
 		}
 
-		fmt.Println("< " + string(message))
+		if strings.TrimSpace(line) == "quit" {
+			return
+		}
 	}
 }
@@ -0,0 +1,39 @@
+//go:build linux && !386
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// acceptQueue returns the number of connections waiting to be accepted by the
+// listener and the size of its queue, which Linux reports in the unacked and
+// sacked fields of the TCP_INFO of listening sockets. ok is false if they
+// can't be read, e.g. for unix sockets.
+func acceptQueue(listener net.Listener) (queued, size int, ok bool) {
+	sc, isConn := listener.(syscall.Conn)
+	if !isConn {
+		return 0, 0, false
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, 0, false
+	}
+
+	var info syscall.TCPInfo
+	var errno syscall.Errno
+	if err := rc.Control(func(fd uintptr) {
+		length := uint32(unsafe.Sizeof(info))
+		_, _, errno = syscall.Syscall6(
+			syscall.SYS_GETSOCKOPT, fd, syscall.IPPROTO_TCP, syscall.TCP_INFO,
+			uintptr(unsafe.Pointer(&info)), uintptr(unsafe.Pointer(&length)), 0,
+		)
+	}); err != nil || errno != 0 {
+		return 0, 0, false
+	}
+
+	return int(info.Unacked), int(info.Sacked), true
+}
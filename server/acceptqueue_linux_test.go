@@ -0,0 +1,48 @@
+//go:build linux && !386
+
+package server
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcceptQueue(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	if err := setBacklog(listener, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+
+	// the handshakes complete in the background
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		queued, size, ok := acceptQueue(listener)
+		if !ok {
+			t.Fatal("the accept queue can't be read")
+		}
+		if size != 4 {
+			t.Fatalf("the accept queue holds up to %d connections, want 4", size)
+		}
+		if queued == 3 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d connections are queued, want 3", queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !linux || 386
+
+package server
+
+import "net"
+
+// acceptQueue returns the number of connections waiting to be accepted by the
+// listener and the size of its queue, which is only supported on Linux.
+func acceptQueue(listener net.Listener) (queued, size int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// aclUser is a user allowed to run some commands on some keys.
+type aclUser struct {
+	name     string
+	password string
+	// commands and categories list the commands the user may run, by name
+	// and by flag, every command being allowed if allCommands is set
+	commands    map[string]bool
+	categories  commandFlags
+	allCommands bool
+	// keys holds the patterns of the keys the user may access, in the syntax
+	// of path.Match, every key being allowed if allKeys is set
+	keys    []string
+	allKeys bool
+}
+
+// aclCategories maps the categories usable in ACL files to the flags of the
+// commands they allow, as reported by the command command.
+var aclCategories = map[string]commandFlags{
+	"@write":      flagWrite,
+	"@readonly":   flagReadOnly,
+	"@connection": flagConnection,
+	"@admin":      flagAdmin,
+}
+
+// loadACLFile reads the users defined in the ACL file. Every line of the file
+// defines a user as four fields separated by whitespace: its name, its
+// password, the commands it may run and the patterns of the keys it may
+// access. Commands are given by name or by category, such as @readonly, and
+// both commands and patterns are separated by commas, '*' allowing all of
+// them. Commands on the connection, such as ping, are allowed to every user
+// except those administering the server, see flagAdmin. Empty lines and lines
+// starting with '#' are skipped.
+func loadACLFile(path string) (map[string]*aclUser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	users := make(map[string]*aclUser)
+
+	for n := 1; ; n++ {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+		if line != "" && !strings.HasPrefix(line, "#") {
+			user, err := parseACLUser(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			if _, ok := users[user.name]; ok {
+				return nil, fmt.Errorf("%s:%d: user '%s' is defined twice", path, n, user.name)
+			}
+
+			users[user.name] = user
+		}
+
+		if err == io.EOF {
+			return users, nil
+		}
+	}
+}
+
+func parseACLUser(line string) (*aclUser, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 {
+		return nil, fmt.Errorf("expected 'name password commands keys'")
+	}
+
+	user := &aclUser{
+		name:     fields[0],
+		password: fields[1],
+		commands: make(map[string]bool),
+	}
+
+	for _, command := range strings.Split(fields[2], ",") {
+		if command == "*" {
+			user.allCommands = true
+		} else if flags, ok := aclCategories[command]; ok {
+			user.categories |= flags
+		} else if _, ok := commandsByName[command]; ok {
+			user.commands[command] = true
+		} else {
+			return nil, fmt.Errorf("unknown command or category '%s'", command)
+		}
+	}
+
+	for _, pattern := range strings.Split(fields[3], ",") {
+		if pattern == "*" {
+			user.allKeys = true
+		} else if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid key pattern '%s'", pattern)
+		}
+
+		user.keys = append(user.keys, pattern)
+	}
+
+	return user, nil
+}
+
+// mayRun reports whether the user may run the command.
+func (u *aclUser) mayRun(spec *commandSpec) bool {
+	if spec.flags&flagConnection != 0 && spec.flags&flagAdmin == 0 {
+		return true
+	}
+	return u.allCommands || u.commands[spec.name] || spec.flags&u.categories != 0
+}
+
+// mayAccess reports whether the user may access the key.
+func (u *aclUser) mayAccess(key string) bool {
+	if u.allKeys {
+		return true
+	}
+
+	for _, pattern := range u.keys {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkPermission checks that the user the connection authenticated as may
+// run the command on its keys, and returns the error to reply otherwise.
+// Commands on the storage are checked against the keys they access once
+// prefixed with the namespace of the connection, so that a namespace can't
+// be used to reach keys the user may not access.
+func checkPermission(s *session, spec *commandSpec, args []string) (string, bool) {
+	if spec.name == "auth" || spec.name == "quit" {
+		return "", true
+	}
+	// the command following noreply is checked on its own
+	if spec.name == "noreply" {
+		return "", true
+	}
+	if s.user == nil {
+		return "NOAUTH authentication required, run 'auth username password'", false
+	}
+
+	if !s.user.mayRun(spec) {
+		return fmt.Sprintf("NOPERM user '%s' may not run '%s'", s.user.name, spec.name), false
+	}
+
+	keys, unnamed := keysOf(spec, args)
+	if unnamed && !s.user.allKeys {
+		return fmt.Sprintf("NOPERM user '%s' may not run '%s', which may access any key", s.user.name, spec.name), false
+	}
+
+	for _, key := range keys {
+		if s.namespace != "" {
+			key = s.namespace + namespaceSeparator + key
+		}
+		if !s.user.mayAccess(key) {
+			return fmt.Sprintf("NOPERM user '%s' may not access key '%s'", s.user.name, key), false
+		}
+	}
+
+	return "", true
+}
+
+// keysOf returns the keys accessed by the command, whose number of arguments
+// has been checked. Every command on the storage has to be listed. unnamed reports whether the command may access keys which
+// aren't among its arguments, such as the keys a tag is attached to.
+func keysOf(spec *commandSpec, args []string) (keys []string, unnamed bool) {
+	if spec.flags&flagConnection != 0 {
+		return nil, false
+	}
+
+	switch spec.name {
+	case "renamenx":
+		return args[:2], false
+	case "mttl", "pfcount", "pfmerge":
+		return args, false
+	case "eval":
+		return args[1:2], false
+	case "dryrun":
+		if args[0] == "deltag" || args[0] == "delpattern" {
+			return nil, true
+		}
+		return args[1:2], false
+	case "memory":
+		return args[1:2], false
+	case "deltag", "expiretag", "delpattern", "scanvalues":
+		return nil, true
+	case "set", "setne", "get", "getcrc", "getrange", "substr", "getdefault",
+		"getsetex", "del", "unlink", "zadd", "zscore", "zrange", "zrangebyscore",
+		"setbit", "getbit", "bitcount", "pfadd", "object", "incrwithttl",
+		"incrcap", "dump", "restore":
+		return args[:1], false
+	default:
+		// commands on the storage are all listed above, which init checks
+		panic(fmt.Sprintf("keysOf: keys of command '%s' are unknown", spec.name))
+	}
+}
+
+// handleAuth authenticates the connection as the user, whose permissions
+// apply to the following commands.
+func handleAuth(s *session, args []string) string {
+	if s.srv.acl == nil {
+		return "authentication is disabled, restart the server with -acl-file to enable it"
+	}
+
+	user, ok := s.srv.acl[args[0]]
+	if !ok || subtle.ConstantTimeCompare([]byte(user.password), []byte(args[1])) != 1 {
+		return "WRONGPASS invalid username or password"
+	}
+
+	s.user = user
+
+	return "ok"
+}
@@ -0,0 +1,36 @@
+package server
+
+import "testing"
+
+func TestCheckPermission(t *testing.T) {
+	user, err := parseACLUser("reader secret @readonly k,n:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line      string
+		namespace string
+		allowed   bool
+	}{
+		{"ping", "", true},
+		{"timing on", "", true},
+		{"client list", "", false},
+		{"debug sleep 1", "", false},
+		{"get k", "", true},
+		{"get k withttl", "", true},
+		{"get j withttl", "", false},
+		{"get k", "n", true},
+		{"set k v", "", false},
+	}
+
+	for _, test := range tests {
+		s := &session{user: user, namespace: test.namespace, version: protocolLine}
+		command, args := splitLine(test.line)
+
+		message, allowed := checkPermission(s, commandsByName[command], args)
+		if allowed != test.allowed {
+			t.Errorf("checkPermission(%q) = %q, %v, want %v", test.line, message, allowed, test.allowed)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// clientList is the set of the connected clients, along with the traffic of
+// all the connections served so far.
+type clientList struct {
+	mu    sync.Mutex
+	conns map[*clientConn]struct{}
+	// lastID is the ID of the last connection added
+	lastID atomic.Uint64
+
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+}
+
+// clientConn is a client connection counting the bytes read from and written
+// to it.
+type clientConn struct {
+	net.Conn
+	list *clientList
+	// id identifies the connection, IDs are assigned in increasing order
+	// and never reused
+	id uint64
+
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	// lastCommand is the time the last command was received or handled, in
+	// nanoseconds since the Unix epoch
+	lastCommand atomic.Int64
+	// running is set while a command is handled, the connection not being
+	// idle then however long the command takes
+	running atomic.Bool
+
+	// mu is held while a message is sent, so that the message closing the
+	// connection can't interleave with a response. version is the protocol
+	// version once negotiated, and reason why the server closed the
+	// connection if it did.
+	mu      sync.Mutex
+	version byte
+	reason  string
+}
+
+func newClientList() *clientList {
+	return &clientList{conns: make(map[*clientConn]struct{})}
+}
+
+// add registers the connection until it is closed, the returned connection
+// is to be used in its place.
+func (l *clientList) add(conn net.Conn) *clientConn {
+	c := &clientConn{Conn: conn, list: l, id: l.lastID.Add(1)}
+	c.touch()
+
+	l.mu.Lock()
+	l.conns[c] = struct{}{}
+	l.mu.Unlock()
+
+	return c
+}
+
+// count returns the number of connected clients.
+func (l *clientList) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.conns)
+}
+
+// list describes the connected clients, one per line, sorted by ID.
+func (l *clientList) list() string {
+	l.mu.Lock()
+	conns := make([]*clientConn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+
+	lines := make([]string, len(conns))
+	for i, c := range conns {
+		lines[i] = fmt.Sprintf(
+			"id=%d addr=%s idle=%d bytes_read=%d bytes_written=%d",
+			c.id, c.RemoteAddr(), int64(c.idle()/time.Second), c.bytesRead.Load(), c.bytesWritten.Load(),
+		)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// killIdle closes the connections but the caller's which have been idle for
+// longer than the timeout, and returns their number.
+func (l *clientList) killIdle(timeout time.Duration, caller *clientConn) int {
+	var idle []*clientConn
+
+	l.mu.Lock()
+	for c := range l.conns {
+		if c != caller && c.idle() > timeout {
+			idle = append(idle, c)
+		}
+	}
+	l.mu.Unlock()
+
+	// closing the connections makes their handlers fail to read their next
+	// command and return
+	for _, c := range idle {
+		c.closeWithReason(fmt.Sprintf("idle for more than %v", timeout))
+	}
+
+	return len(idle)
+}
+
+// closeAll closes every connection for the reason, which makes their handlers
+// fail to read their next command and return.
+func (l *clientList) closeAll(reason string) {
+	l.mu.Lock()
+	conns := make([]*clientConn, 0, len(l.conns))
+	for c := range l.conns {
+		conns = append(conns, c)
+	}
+	l.mu.Unlock()
+
+	for _, c := range conns {
+		c.closeWithReason(reason)
+	}
+}
+
+// touch records that a command has just been received or handled.
+func (c *clientConn) touch() {
+	c.lastCommand.Store(time.Now().UnixNano())
+}
+
+// idle returns the time since the last command was received or handled, zero
+// while a command is handled.
+func (c *clientConn) idle() time.Duration {
+	if c.running.Load() {
+		return 0
+	}
+	return time.Since(time.Unix(0, c.lastCommand.Load()))
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesRead.Add(uint64(n))
+	c.list.bytesRead.Add(uint64(n))
+
+	return n, err
+}
+
+func (c *clientConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.bytesWritten.Add(uint64(n))
+	c.list.bytesWritten.Add(uint64(n))
+
+	return n, err
+}
+
+// closeWithReason tells the client why the server closes the connection, see
+// protocol.go, and closes it. The reason is only sent over the framed and
+// tagged protocols, if the connection isn't in the middle of sending a
+// response, and if the client reads it in time.
+func (c *clientConn) closeWithReason(reason string) {
+	if c.mu.TryLock() {
+		if c.version >= protocolFramed {
+			c.SetWriteDeadline(time.Now().Add(closeReasonTimeout))
+			// the connection is closed anyway, the client only misses the
+			// reason if sending it fails
+			sendClose(c, c.version, reason)
+		}
+		c.reason = reason
+		c.mu.Unlock()
+	}
+
+	c.Close()
+}
+
+// closeReason returns the reason why the server closed the connection, empty
+// if it didn't or if the reason couldn't be recorded.
+func (c *clientConn) closeReason() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.reason
+}
+
+// Close unregisters the connection and closes it.
+func (c *clientConn) Close() error {
+	c.list.mu.Lock()
+	delete(c.list.conns, c)
+	c.list.mu.Unlock()
+
+	return c.Conn.Close()
+}
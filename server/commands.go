@@ -0,0 +1,255 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commandFlags classify commands by their effect.
+type commandFlags uint8
+
+const (
+	// flagWrite marks commands which may modify the storage
+	flagWrite commandFlags = 1 << iota
+	// flagReadOnly marks commands which read the storage without modifying
+	// it
+	flagReadOnly
+	// flagConnection marks commands which only involve the connection or the
+	// server rather than the storage
+	flagConnection
+	// flagSlow marks commands which may take long to handle, whose time is
+	// bounded by -command-timeout
+	flagSlow
+	// flagAdmin marks the commands on the connection which administer the
+	// server, which ACL users have to be granted explicitly
+	flagAdmin
+)
+
+// commandSpec describes a command and the function handling it.
+type commandSpec struct {
+	name string
+	// minArgs and maxArgs bound the number of arguments as parsed by the
+	// server, maxArgs is -1 if there is no upper bound
+	minArgs int
+	maxArgs int
+	flags   commandFlags
+	usage   string
+	// handler replies to the command, the number of arguments being checked
+	// beforehand
+	handler func(s *session, args []string) string
+}
+
+// commands lists the commands supported by the server, in the order they are
+// reported by the command command. It is filled by init, as the command
+// command refers to it.
+var commands []commandSpec
+
+// commandsByName indexes commands by name.
+var commandsByName = make(map[string]*commandSpec)
+
+func init() {
+	commands = []commandSpec{
+		{"ping", 0, 0, flagConnection, "ping", handlePing},
+		{"command", 0, 2, flagConnection, "command [count | info name]", handleCommand},
+		{"quit", 0, 0, flagConnection, "quit", handleQuit},
+		{"auth", 2, 2, flagConnection, "auth username password", handleAuth},
+		{"consistency", 0, 0, flagConnection, "consistency", handleConsistency},
+		{"info", 0, 0, flagConnection, "info", handleInfo},
+		{"version", 0, 0, flagConnection, "version", handleVersion},
+		{"timing", 1, 1, flagConnection, "timing on|off", handleTiming},
+		{"changes", 1, 1, flagConnection, "changes on|off", handleChanges},
+		{"multibulk", 1, 1, flagConnection, "multibulk on|off", handleMultiBulk},
+		{"noreply", 1, -1, flagConnection, "noreply command [arg ...]", handleNoReply},
+		{"client", 1, 2, flagConnection | flagAdmin, "client id | list | killidle seconds", handleClient},
+		{"namespace", 1, 1, flagConnection, "namespace name", handleNamespace},
+		{"set", 2, 4, flagWrite, "set key value [tag:name] [keepttl]", handleSet},
+		{"deltag", 1, 1, flagWrite, "deltag tag", handleDelTag},
+		{"delpattern", 1, 1, flagWrite | flagSlow, "delpattern pattern", handleDelPattern},
+		{"expiretag", 2, 2, flagWrite, "expiretag tag seconds", handleExpireTag},
+		{"dryrun", 2, 2, flagReadOnly | flagSlow, "dryrun del|unlink|deltag|delpattern key|tag|pattern", handleDryRun},
+		{"setne", 2, 2, flagWrite, "setne key value", handleSetNE},
+		{"get", 1, 2, flagReadOnly, "get key [withttl]", handleGet},
+		{"getcrc", 1, 1, flagReadOnly, "getcrc key", handleGetCRC},
+		{"getrange", 3, 3, flagReadOnly, "getrange key start end", handleGetRange},
+		{"substr", 3, 3, flagReadOnly, "substr key start end", handleGetRange},
+		{"getdefault", 2, 2, flagReadOnly, "getdefault key default", handleGetDefault},
+		{"scanvalues", 2, 2, flagReadOnly | flagSlow, "scanvalues cursor count", handleScanValues},
+		{"mttl", 1, -1, flagReadOnly, "mttl key [key ...]", handleMTTL},
+		{"getsetex", 3, 3, flagWrite, "getsetex key value seconds", handleGetSetEx},
+		{"del", 1, 1, flagWrite, "del key", handleDel},
+		{"unlink", 1, 1, flagWrite, "unlink key", handleUnlink},
+		{"renamenx", 2, 2, flagWrite, "renamenx src dst", handleRenameNX},
+		{"zadd", 3, 3, flagWrite, "zadd key score member", handleZAdd},
+		{"zscore", 2, 2, flagReadOnly, "zscore key member", handleZScore},
+		{"zrange", 3, 4, flagReadOnly, "zrange key start stop [withscores]", handleZRange},
+		{"zrangebyscore", 3, 6, flagReadOnly, "zrangebyscore key min max [limit offset count]", handleZRangeByScore},
+		{"setbit", 3, 3, flagWrite, "setbit key offset value", handleSetBit},
+		{"getbit", 2, 2, flagReadOnly, "getbit key offset", handleGetBit},
+		{"bitcount", 1, 3, flagReadOnly, "bitcount key [start end]", handleBitCount},
+		{"pfadd", 2, -1, flagWrite, "pfadd key element [element ...]", handlePFAdd},
+		{"pfcount", 1, -1, flagReadOnly, "pfcount key [key ...]", handlePFCount},
+		{"pfmerge", 2, -1, flagWrite, "pfmerge dest src [src ...]", handlePFMerge},
+		{"memory", 2, 2, flagReadOnly, "memory usage key", handleMemory},
+		{"object", 1, 1, flagReadOnly, "object key", handleObject},
+		{"eval", 4, 4, flagWrite, "eval ifgt|iflt|ifeq key operand value", handleEval},
+		{"incrwithttl", 2, 2, flagWrite, "incrwithttl key seconds", handleIncrWithTTL},
+		{"incrcap", 2, 2, flagWrite, "incrcap key max", handleIncrCap},
+		{"dump", 1, 1, flagReadOnly, "dump key", handleDump},
+		{"restore", 3, 3, flagWrite, "restore key ttl-milliseconds dump", handleRestore},
+		{"debug", 2, 2, flagConnection | flagSlow | flagAdmin, "debug sleep milliseconds", handleDebug},
+	}
+
+	for i := range commands {
+		commandsByName[commands[i].name] = &commands[i]
+	}
+
+	// keysOf panics on the commands on the storage it doesn't list, so that
+	// a command added without telling which keys it accesses is caught on
+	// startup rather than escaping the ACLs
+	for i := range commands {
+		keysOf(&commands[i], make([]string, commands[i].minArgs))
+	}
+}
+
+// dispatch checks the number of arguments of the command and runs its
+// handler, returning the response. Commands on the storage are rejected
+// rather than queued once -max-queue-depth commands are pending.
+func dispatch(s *session, command string, args []string) string {
+	spec, ok := commandsByName[command]
+	if !ok {
+		return fmt.Sprintf("unknown command '%s', run 'command' to list supported commands", command)
+	}
+
+	if len(args) < spec.minArgs || (spec.maxArgs >= 0 && len(args) > spec.maxArgs) {
+		return "usage: " + spec.usage
+	}
+
+	if s.srv.acl != nil {
+		if message, ok := checkPermission(s, spec, args); !ok {
+			return message
+		}
+	}
+
+	if spec.flags&flagConnection == 0 {
+		if s.srv.opts.MaxQueueDepth > 0 && s.srv.queueDepth.Load() >= s.srv.opts.MaxQueueDepth {
+			return "server overloaded"
+		}
+
+		s.srv.queueDepth.Add(1)
+	}
+
+	if spec.flags&flagSlow != 0 && s.srv.opts.CommandTimeout > 0 {
+		return runWithTimeout(s, spec, args, s.srv.opts.CommandTimeout)
+	}
+
+	if spec.flags&flagConnection == 0 {
+		defer s.srv.queueDepth.Add(-1)
+	}
+
+	return spec.handler(s, args)
+}
+
+// runWithTimeout runs the handler of the command on its own goroutine, and
+// gives up waiting for it once the timeout has elapsed. Storage operations
+// can't be aborted halfway, so a command which timed out still runs to
+// completion in the background, its response being dropped, and keeps
+// counting in the queue depth until then. The handler gets a copy of the
+// session, so that the following commands may change the session meanwhile.
+func runWithTimeout(s *session, spec *commandSpec, args []string, timeout time.Duration) string {
+	sc := *s
+	response := make(chan string, 1)
+	go func() {
+		if spec.flags&flagConnection == 0 {
+			defer s.srv.queueDepth.Add(-1)
+		}
+		response <- spec.handler(&sc, args)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case message := <-response:
+		s.multi, s.elements = sc.multi, sc.elements
+		return message
+	case <-timer.C:
+		return "command timed out"
+	}
+}
+
+// handleNoReply handles the command following it, whose response is dropped
+// rather than sent, see protocol.go.
+func handleNoReply(s *session, args []string) string {
+	message := dispatch(s, args[0], args[1:])
+	s.noReply = true
+
+	return message
+}
+
+func handlePing(s *session, args []string) string {
+	return "pong"
+}
+
+func handleQuit(s *session, args []string) string {
+	return "bye"
+}
+
+func handleVersion(s *session, args []string) string {
+	return s.srv.opts.BuildInfo
+}
+
+// handleCommand lists the supported commands, or describes them with the
+// count and info subcommands.
+func handleCommand(s *session, args []string) string {
+	switch {
+	case len(args) == 0:
+		names := make([]string, len(commands))
+		for i, spec := range commands {
+			names[i] = spec.name
+		}
+
+		return strings.Join(names, "\n")
+	case len(args) == 1 && args[0] == "count":
+		return strconv.Itoa(len(commands))
+	case len(args) == 2 && args[0] == "info":
+		if spec, ok := commandsByName[args[1]]; ok {
+			return formatCommandSpec(*spec)
+		}
+
+		return "not found"
+	default:
+		return "usage: command [count | info name]"
+	}
+}
+
+// formatCommandSpec describes the command as 'name:value' lines.
+func formatCommandSpec(spec commandSpec) string {
+	var flags []string
+	if spec.flags&flagWrite != 0 {
+		flags = append(flags, "write")
+	}
+	if spec.flags&flagReadOnly != 0 {
+		flags = append(flags, "readonly")
+	}
+	if spec.flags&flagConnection != 0 {
+		flags = append(flags, "connection")
+	}
+	if spec.flags&flagSlow != 0 {
+		flags = append(flags, "slow")
+	}
+	if spec.flags&flagAdmin != 0 {
+		flags = append(flags, "admin")
+	}
+
+	lines := []string{
+		fmt.Sprintf("name:%s", spec.name),
+		fmt.Sprintf("min_args:%d", spec.minArgs),
+		fmt.Sprintf("max_args:%d", spec.maxArgs),
+		fmt.Sprintf("flags:%s", strings.Join(flags, ",")),
+		fmt.Sprintf("usage:%s", spec.usage),
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/eqld/carrot/client"
+)
+
+// TestClientArities checks that the client knows every command and checks
+// their arguments as the server does. Over the line protocol, the last
+// argument of the commands in lineArgCounts takes the rest of the line,
+// spaces included, so the client can't bound the number of words.
+func TestClientArities(t *testing.T) {
+	for _, spec := range commands {
+		min, max, ok := client.Arity(spec.name)
+		if !ok {
+			t.Errorf("the client doesn't know the %s command", spec.name)
+			continue
+		}
+
+		wantMax := spec.maxArgs
+		if _, ok := lineArgCounts[spec.name]; ok {
+			wantMax = -1
+		}
+		if min != spec.minArgs || max != wantMax {
+			t.Errorf("the client accepts %d to %d arguments for %s, want %d to %d", min, max, spec.name, spec.minArgs, wantMax)
+		}
+	}
+}
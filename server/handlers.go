@@ -0,0 +1,897 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eqld/carrot/storage"
+)
+
+func handleConsistency(s *session, args []string) string {
+	// every write is applied by the storage goroutine before it is
+	// acknowledged and there are no asynchronous write paths, so a command
+	// observes every write acknowledged before it was sent, including the
+	// connection's own
+	return "linearizable, which implies read-your-writes"
+}
+
+func handleClient(s *session, args []string) string {
+	const usage = "usage: client id | list | killidle seconds"
+
+	switch {
+	case len(args) == 1 && args[0] == "id":
+		return strconv.FormatUint(s.conn.id, 10)
+	case len(args) == 1 && args[0] == "list":
+		return s.srv.clients.list()
+	case len(args) == 2 && args[0] == "killidle":
+		timeout, err := parseDuration(args[1], time.Second)
+		if err != nil {
+			return fmt.Sprintf("invalid timeout '%s', expected seconds", args[1])
+		}
+
+		return strconv.Itoa(s.srv.clients.killIdle(timeout, s.conn))
+	default:
+		return usage
+	}
+}
+
+func handleTiming(s *session, args []string) string {
+	switch args[0] {
+	case "on":
+		s.timing = true
+	case "off":
+		s.timing = false
+	default:
+		return "usage: timing on|off"
+	}
+
+	return "ok"
+}
+
+// handleMultiBulk switches multi-bulk responses on or off, see protocol.go.
+func handleMultiBulk(s *session, args []string) string {
+	if s.version < protocolFramed {
+		return "multi-bulk responses are only supported over the framed protocol"
+	}
+
+	switch args[0] {
+	case "on":
+		s.multiBulk = true
+	case "off":
+		s.multiBulk = false
+	default:
+		return "usage: multibulk on|off"
+	}
+
+	return "ok"
+}
+
+// formatMulti replies the elements as a multi-bulk response if the connection
+// switched them on, or joined with newlines otherwise.
+func formatMulti(s *session, elements []string) string {
+	if s.multiBulk {
+		s.multi, s.elements = true, elements
+		return ""
+	}
+
+	return strings.Join(elements, "\n")
+}
+
+func handleChanges(s *session, args []string) string {
+	switch args[0] {
+	case "on":
+		s.changes = true
+	case "off":
+		s.changes = false
+	default:
+		return "usage: changes on|off"
+	}
+
+	return "ok"
+}
+
+func handleNamespace(s *session, args []string) string {
+	// the namespace can't be changed once set, so that a connection handed
+	// to a tenant stays confined to its keys
+	if s.namespace != "" {
+		return fmt.Sprintf("namespace is already set to '%s'", s.namespace)
+	}
+	if args[0] == "" || strings.Contains(args[0], " ") {
+		return "usage: namespace name"
+	}
+	if strings.Contains(args[0], namespaceSeparator) {
+		return fmt.Sprintf("namespace names can't contain '%s'", namespaceSeparator)
+	}
+
+	s.namespace = args[0]
+	s.store = newNamespacedStore(s.store, s.namespace)
+
+	return "ok"
+}
+
+func handleSet(s *session, args []string) string {
+	a, ok := parseSetArgs(args, s.version)
+	if !ok {
+		return "usage: set key value [tag:name] [keepttl]"
+	}
+
+	if err := s.srv.checkValueSize(a.value); err != nil {
+		return err.Error()
+	}
+
+	var changed bool
+	var err error
+	switch {
+	case a.keepTTL:
+		changed, err = s.store.SetKeepTTL(a.key, a.value, a.tag)
+	case s.changes:
+		changed, err = s.store.SetChanged(a.key, a.value, a.tag)
+	case a.tag != "":
+		err = s.store.SetTagged(a.key, a.value, a.tag)
+	default:
+		err = s.store.Set(a.key, a.value)
+	}
+
+	switch {
+	case err != nil:
+		return err.Error()
+	case s.changes:
+		return formatBit(changed)
+	default:
+		return "ok"
+	}
+}
+
+func handleRenameNX(s *session, args []string) string {
+	if renamed, ok := s.store.RenameNX(args[0], args[1]); ok {
+		return formatBit(renamed)
+	}
+	return "not found"
+}
+
+// handleDelPattern removes the keys matching the pattern, which requires
+// -allow-delpattern as a mistyped pattern could wipe the whole keyspace.
+func handleDelPattern(s *session, args []string) string {
+	if !s.srv.opts.AllowDelPattern {
+		return "delpattern is disabled, restart the server with -allow-delpattern to enable it"
+	}
+
+	removed, err := s.store.DelPattern(args[0])
+	if err != nil {
+		return fmt.Sprintf("invalid pattern '%s'", args[0])
+	}
+
+	return strconv.Itoa(removed)
+}
+
+func handleDelTag(s *session, args []string) string {
+	return strconv.Itoa(s.store.DelTag(args[0]))
+}
+
+func handleExpireTag(s *session, args []string) string {
+	ttl, err := parseDuration(args[1], time.Second)
+	if err != nil || ttl == 0 {
+		return fmt.Sprintf("invalid ttl '%s', expected a positive number of seconds", args[1])
+	}
+
+	return strconv.Itoa(s.store.ExpireTag(args[0], ttl))
+}
+
+func handleSetNE(s *session, args []string) string {
+	key, value := args[0], args[1]
+
+	if err := s.srv.checkValueSize(value); err != nil {
+		return err.Error()
+	}
+
+	changed, err := s.store.SetNE(key, value)
+	if err != nil {
+		return err.Error()
+	}
+
+	return formatBit(changed)
+}
+
+// handleGet replies the value of the key, followed on the next line by its
+// ttl in seconds, -1 for keys without an expiration time, if withttl is given.
+// Over the line protocol, a key ending with ' withttl' is taken as a request
+// for the ttl, see splitLine.
+func handleGet(s *session, args []string) string {
+	key, withTTL := args[0], false
+	if len(args) == 2 {
+		if args[1] != "withttl" {
+			return "usage: get key [withttl]"
+		}
+		withTTL = true
+	}
+
+	if !withTTL {
+		value, ok, err := s.store.Get(key)
+		switch {
+		case err != nil:
+			return err.Error()
+		case ok:
+			return fmt.Sprintf("found: %s", value)
+		default:
+			return "not found"
+		}
+	}
+
+	value, ttl, ok, err := s.store.GetWithTTL(key)
+	switch {
+	case err != nil:
+		return err.Error()
+	case ok:
+		seconds := int64(-1)
+		if ttl >= 0 {
+			seconds = int64(ttl.Round(time.Second) / time.Second)
+		}
+		return formatMulti(s, []string{"found: " + value, strconv.FormatInt(seconds, 10)})
+	default:
+		return "not found"
+	}
+}
+
+func handleGetCRC(s *session, args []string) string {
+	value, crc, ok, err := s.store.GetChecksum(args[0])
+	switch {
+	case err != nil:
+		return err.Error()
+	case ok:
+		return fmt.Sprintf("found: %08x %s", crc, value)
+	default:
+		return "not found"
+	}
+}
+
+func handleGetDefault(s *session, args []string) string {
+	value, found, err := s.store.GetDefault(args[0], args[1])
+	switch {
+	case err != nil:
+		return err.Error()
+	case found:
+		return fmt.Sprintf("found: %s", value)
+	default:
+		return fmt.Sprintf("default: %s", value)
+	}
+}
+
+func handleGetSetEx(s *session, args []string) string {
+	key, value := args[0], args[1]
+
+	if err := s.srv.checkValueSize(value); err != nil {
+		return err.Error()
+	}
+
+	ttl, err := parseDuration(args[2], time.Second)
+	if err != nil || ttl == 0 {
+		return fmt.Sprintf("invalid ttl '%s', expected a positive number of seconds", args[2])
+	}
+
+	old, ok, err := s.store.GetSetEx(key, value, ttl)
+	switch {
+	case err != nil:
+		return err.Error()
+	case ok:
+		return fmt.Sprintf("found: %s", old)
+	default:
+		return "not found"
+	}
+}
+
+func handleDel(s *session, args []string) string {
+	return formatChanged(s, s.store.Del(args[0]))
+}
+
+func handleUnlink(s *session, args []string) string {
+	return formatChanged(s, s.store.Unlink(args[0]))
+}
+
+// formatChanged acknowledges a write with 'ok', or replies whether it changed
+// anything if the session asked to be told.
+func formatChanged(s *session, changed bool) string {
+	if s.changes {
+		return formatBit(changed)
+	}
+	return "ok"
+}
+
+func handleMemory(s *session, args []string) string {
+	subcommand, key := args[0], args[1]
+
+	if subcommand != "usage" || key == "" {
+		return "usage: memory usage key"
+	}
+
+	if bytes, ok := s.store.MemoryUsage(key); ok {
+		return strconv.Itoa(bytes)
+	}
+	return "not found"
+}
+
+func handleObject(s *session, args []string) string {
+	if info, ok := s.store.Object(args[0]); ok {
+		return formatObjectInfo(info)
+	}
+	return "not found"
+}
+
+func handleIncrWithTTL(s *session, args []string) string {
+	ttl, err := parseDuration(args[1], time.Second)
+	if err != nil || ttl == 0 {
+		return fmt.Sprintf("invalid ttl '%s', expected a positive number of seconds", args[1])
+	}
+
+	value, err := s.store.IncrWithTTL(args[0], ttl)
+	if err != nil {
+		return err.Error()
+	}
+
+	return strconv.FormatInt(value, 10)
+}
+
+// handleMTTL replies the ttl in seconds of every key, -1 for keys without an
+// expiration time and -2 for missing keys.
+func handleMTTL(s *session, args []string) string {
+	ttls := s.store.TTLs(args)
+
+	elements := make([]string, len(ttls))
+	for i, ttl := range ttls {
+		seconds := int64(ttl)
+		if ttl >= 0 {
+			seconds = int64(ttl.Round(time.Second) / time.Second)
+		}
+		elements[i] = strconv.FormatInt(seconds, 10)
+	}
+
+	return formatMulti(s, elements)
+}
+
+// handleScanValues replies a page of the keys holding strings along with their
+// strings, preceded by the cursor to pass to get the next page. Cursors are
+// the last key of a page encoded in hex, so that they fit on a command line,
+// '0' starting a scan and being replied once it is complete.
+func handleScanValues(s *session, args []string) string {
+	var after []byte
+	if args[0] != "0" {
+		var err error
+		if after, err = hex.DecodeString(args[0]); err != nil {
+			return fmt.Sprintf("invalid cursor '%s'", args[0])
+		}
+	}
+
+	count, err := strconv.Atoi(args[1])
+	if err != nil || count <= 0 {
+		return fmt.Sprintf("invalid count '%s', expected a positive integer", args[1])
+	}
+
+	pairs, more := s.store.Scan("", string(after), count)
+
+	cursor := "0"
+	if more {
+		cursor = hex.EncodeToString([]byte(pairs[len(pairs)-1].Key))
+	}
+
+	elements := make([]string, 0, 1+2*len(pairs))
+	elements = append(elements, cursor)
+	for _, pair := range pairs {
+		elements = append(elements, pair.Key, pair.Value)
+	}
+
+	return formatMulti(s, elements)
+}
+
+// handleIncrCap replies the incremented value, followed on the next line by
+// whether it was capped.
+func handleIncrCap(s *session, args []string) string {
+	max, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return fmt.Sprintf("invalid max '%s', expected an integer", args[1])
+	}
+
+	value, capped, err := s.store.IncrCap(args[0], max)
+	if err != nil {
+		return err.Error()
+	}
+
+	return formatMulti(s, []string{strconv.FormatInt(value, 10), formatBit(capped)})
+}
+
+func handleDump(s *session, args []string) string {
+	if blob, ok := s.store.Dump(args[0]); ok {
+		return fmt.Sprintf("found: %s", base64.StdEncoding.EncodeToString(blob))
+	}
+	return "not found"
+}
+
+func handleRestore(s *session, args []string) string {
+	ttl, err := parseDuration(args[1], time.Millisecond)
+	if err != nil {
+		return fmt.Sprintf("invalid ttl '%s', expected milliseconds", args[1])
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(args[2])
+	if err != nil {
+		return storage.ErrCorruptDump.Error()
+	}
+	if n, ok := storage.DumpedStringLen(blob); ok {
+		if err := s.srv.checkValueLen(n); err != nil {
+			return err.Error()
+		}
+	}
+
+	if err := s.store.Restore(args[0], ttl, blob); err != nil {
+		return err.Error()
+	}
+
+	return "ok"
+}
+
+// setArgs are the arguments of set.
+type setArgs struct {
+	key   string
+	value string
+	// tag is the tag given as a 'tag:name' option, if any
+	tag string
+	// keepTTL is set by the keepttl option
+	keepTTL bool
+}
+
+// parseSetArgs splits the arguments of set into the key, the value and the
+// options following it, a 'tag:name' option and a keepttl option given in any
+// order. The line protocol can't tell the options apart from the end of the
+// value, so there a value ending with a space followed by an option is taken
+// as given the option.
+func parseSetArgs(args []string, version byte) (setArgs, bool) {
+	a := setArgs{key: args[0], value: args[1]}
+	options := args[2:]
+
+	if version == protocolLine {
+		options = nil
+		for len(options) < 2 {
+			i := strings.LastIndexByte(a.value, ' ')
+			if i < 0 {
+				break
+			}
+			option := a.value[i+1:]
+			if option != "keepttl" && !strings.HasPrefix(option, "tag:") {
+				break
+			}
+			a.value, options = a.value[:i], append(options, option)
+		}
+	}
+
+	for _, option := range options {
+		if option == "keepttl" && !a.keepTTL {
+			a.keepTTL = true
+			continue
+		}
+
+		tag, ok := strings.CutPrefix(option, "tag:")
+		if !ok || tag == "" || a.tag != "" {
+			return setArgs{}, false
+		}
+		a.tag = tag
+	}
+
+	return a, true
+}
+
+// handleDryRun replies the number of keys the destructive command given by the
+// arguments would remove, without running it. A delpattern dry run doesn't
+// need -allow-delpattern, as it removes nothing.
+func handleDryRun(s *session, args []string) string {
+	removed := 0
+	switch args[0] {
+	case "del", "unlink":
+		if _, ok := s.store.Object(args[1]); ok {
+			removed = 1
+		}
+	case "deltag":
+		removed = s.store.CountTag(args[1])
+	case "delpattern":
+		var err error
+		if removed, err = s.store.CountPattern(args[1]); err != nil {
+			return fmt.Sprintf("invalid pattern '%s'", args[1])
+		}
+	default:
+		return "usage: dryrun del|unlink|deltag|delpattern key|tag|pattern"
+	}
+
+	return strconv.Itoa(removed)
+}
+
+// handleInfo reports the state of the server as 'name:value' lines.
+func handleInfo(s *session, args []string) string {
+	stats := s.store.Stats()
+
+	lines := []string{
+		fmt.Sprintf("keys:%d", stats.Keys),
+		fmt.Sprintf("compactions_total:%d", stats.Compactions),
+		fmt.Sprintf("compaction_time_ms:%d", stats.CompactionTime.Milliseconds()),
+		fmt.Sprintf("evicted_keys:%d", stats.Evictions),
+		fmt.Sprintf("expired_keys:%d", stats.Expirations),
+		fmt.Sprintf("deleted_keys:%d", stats.Deletions),
+		fmt.Sprintf("storage_queue_depth:%d", s.srv.queueDepth.Load()),
+		fmt.Sprintf("connected_clients:%d", s.srv.clients.count()),
+		fmt.Sprintf("total_net_input_bytes:%d", s.srv.clients.bytesRead.Load()),
+		fmt.Sprintf("total_net_output_bytes:%d", s.srv.clients.bytesWritten.Load()),
+		runtimeInfo(),
+	}
+	if s.srv.opts.BuildInfo != "" {
+		lines = append(lines, s.srv.opts.BuildInfo)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// runtimeInfo reports the memory, goroutine and garbage collection statistics
+// of the process as 'name:value' lines, so that they can be compared with the
+// number of keys.
+func runtimeInfo() string {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+
+	lastPause := time.Duration(0)
+	if m.NumGC > 0 {
+		lastPause = time.Duration(m.PauseNs[(m.NumGC+255)%256])
+	}
+
+	lines := []string{
+		fmt.Sprintf("heap_alloc_bytes:%d", m.HeapAlloc),
+		fmt.Sprintf("heap_inuse_bytes:%d", m.HeapInuse),
+		fmt.Sprintf("heap_objects:%d", m.HeapObjects),
+		fmt.Sprintf("sys_bytes:%d", m.Sys),
+		fmt.Sprintf("goroutines:%d", runtime.NumGoroutine()),
+		fmt.Sprintf("gc_runs_total:%d", m.NumGC),
+		fmt.Sprintf("gc_pause_total_ms:%d", time.Duration(m.PauseTotalNs).Milliseconds()),
+		fmt.Sprintf("gc_last_pause_us:%d", lastPause.Microseconds()),
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+func handleZAdd(s *session, args []string) string {
+	key, rawScore, member := args[0], args[1], args[2]
+
+	score, err := strconv.ParseFloat(rawScore, 64)
+	if err != nil || math.IsNaN(score) {
+		return fmt.Sprintf("invalid score '%s'", rawScore)
+	}
+
+	changed, err := s.store.ZAdd(key, score, member)
+	if err != nil {
+		return err.Error()
+	}
+
+	return formatChanged(s, changed)
+}
+
+func handleZScore(s *session, args []string) string {
+	score, ok, err := s.store.ZScore(args[0], args[1])
+	switch {
+	case err != nil:
+		return err.Error()
+	case ok:
+		return fmt.Sprintf("found: %s", formatScore(score))
+	default:
+		return "not found"
+	}
+}
+
+func handleZRange(s *session, args []string) string {
+	if len(args) == 4 && args[3] != "withscores" {
+		return "usage: zrange key start stop [withscores]"
+	}
+
+	start, errStart := strconv.Atoi(args[1])
+	stop, errStop := strconv.Atoi(args[2])
+	if errStart != nil || errStop != nil {
+		return "start and stop must be integers"
+	}
+
+	members, err := s.store.ZRange(args[0], start, stop)
+	if err != nil {
+		return err.Error()
+	}
+
+	return formatScoredMembers(s, members, len(args) == 4)
+}
+
+func handleZRangeByScore(s *session, args []string) string {
+	if (len(args) != 3 && len(args) != 6) || (len(args) == 6 && args[3] != "limit") {
+		return "usage: zrangebyscore key min max [limit offset count]"
+	}
+
+	min, errMin := parseScoreBound(args[1])
+	max, errMax := parseScoreBound(args[2])
+	if errMin != nil || errMax != nil {
+		return "min and max must be numbers, optionally prefixed with '(' to exclude them"
+	}
+
+	offset, count := 0, -1
+	if len(args) == 6 {
+		var errOffset, errCount error
+		offset, errOffset = strconv.Atoi(args[4])
+		count, errCount = strconv.Atoi(args[5])
+		if errOffset != nil || errCount != nil {
+			return "offset and count must be integers"
+		}
+		if offset < 0 {
+			return "offset must not be negative"
+		}
+	}
+
+	members, err := s.store.ZRangeByScore(args[0], min, max, offset, count)
+	if err != nil {
+		return err.Error()
+	}
+
+	return formatScoredMembers(s, members, false)
+}
+
+// formatScoredMembers lists members one per line, each followed by its score
+// on the next line if withScores is set.
+func formatScoredMembers(s *session, members []storage.ScoredMember, withScores bool) string {
+	if len(members) == 0 && !s.multiBulk {
+		return "empty"
+	}
+
+	lines := make([]string, 0, 2*len(members))
+	for _, m := range members {
+		lines = append(lines, m.Member)
+		if withScores {
+			lines = append(lines, formatScore(m.Score))
+		}
+	}
+
+	return formatMulti(s, lines)
+}
+
+// parseScoreBound parses a score range bound such as '1.5', '(1.5' for an
+// exclusive bound, '-inf' or '+inf'.
+func parseScoreBound(s string) (storage.ScoreBound, error) {
+	bound := storage.ScoreBound{}
+	if strings.HasPrefix(s, "(") {
+		bound.Exclusive = true
+		s = s[1:]
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(value) {
+		return bound, fmt.Errorf("invalid score bound '%s'", s)
+	}
+	bound.Value = value
+
+	return bound, nil
+}
+
+func formatScore(score float64) string {
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// maxBitOffset bounds the offsets of the bits read, a bitmap is a plain value
+// and can't outgrow the max value length. The offsets of the bits set are
+// bounded by the max value size, see checkValueSize.
+const maxBitOffset = 8*math.MaxUint32 - 1
+
+func handleSetBit(s *session, args []string) string {
+	// setting a bit grows the value up to the byte holding it
+	maxOffset := uint64(8*s.srv.opts.MaxValueSize - 1)
+	offset, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil || offset > maxOffset {
+		return fmt.Sprintf("bit offset must be an integer between 0 and %d", maxOffset)
+	}
+	if args[2] != "0" && args[2] != "1" {
+		return "bit value must be either 0 or 1"
+	}
+
+	old, err := s.store.SetBit(args[0], offset, args[2] == "1")
+	if err != nil {
+		return err.Error()
+	}
+
+	return formatBit(old)
+}
+
+func handleGetBit(s *session, args []string) string {
+	offset, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil || offset > maxBitOffset {
+		return fmt.Sprintf("bit offset must be an integer between 0 and %d", uint64(maxBitOffset))
+	}
+
+	bit, err := s.store.GetBit(args[0], offset)
+	if err != nil {
+		return err.Error()
+	}
+
+	return formatBit(bit)
+}
+
+func handleBitCount(s *session, args []string) string {
+	if len(args) == 2 {
+		return "usage: bitcount key [start end]"
+	}
+
+	start, end := 0, -1
+	if len(args) == 3 {
+		var errStart, errEnd error
+		start, errStart = strconv.Atoi(args[1])
+		end, errEnd = strconv.Atoi(args[2])
+		if errStart != nil || errEnd != nil {
+			return "start and end must be integers"
+		}
+	}
+
+	count, err := s.store.BitCount(args[0], start, end)
+	if err != nil {
+		return err.Error()
+	}
+
+	return strconv.Itoa(count)
+}
+
+// handleGetRange replies the bytes of the string stored under the key between
+// start and end, it handles substr as well.
+func handleGetRange(s *session, args []string) string {
+	start, errStart := strconv.Atoi(args[1])
+	end, errEnd := strconv.Atoi(args[2])
+	if errStart != nil || errEnd != nil {
+		return "start and end must be integers"
+	}
+
+	value, ok, err := s.store.GetRange(args[0], start, end)
+	switch {
+	case err != nil:
+		return err.Error()
+	case ok:
+		return fmt.Sprintf("found: %s", value)
+	default:
+		return "not found"
+	}
+}
+
+func formatBit(bit bool) string {
+	if bit {
+		return "1"
+	}
+	return "0"
+}
+
+func handlePFAdd(s *session, args []string) string {
+	changed, err := s.store.PFAdd(args[0], args[1:])
+	if err != nil {
+		return err.Error()
+	}
+
+	return formatBit(changed)
+}
+
+func handlePFCount(s *session, args []string) string {
+	count, err := s.store.PFCount(args)
+	if err != nil {
+		return err.Error()
+	}
+
+	return strconv.FormatUint(count, 10)
+}
+
+func handlePFMerge(s *session, args []string) string {
+	if err := s.store.PFMerge(args[0], args[1:]); err != nil {
+		return err.Error()
+	}
+
+	return "ok"
+}
+
+// formatObjectInfo lists the fields of the info as 'name:value' lines, the ttl
+// is -1 for keys without an expiration time.
+func formatObjectInfo(info storage.ObjectInfo) string {
+	ttl := int64(-1)
+	if info.HasTTL {
+		ttl = int64(info.TTL.Round(time.Second) / time.Second)
+	}
+
+	lines := []string{
+		fmt.Sprintf("type:%s", info.Type),
+		fmt.Sprintf("encoding:%s", info.Encoding),
+		fmt.Sprintf("idletime:%d", int64(info.Idle/time.Second)),
+		fmt.Sprintf("ttl:%d", ttl),
+		fmt.Sprintf("memory:%d", info.Memory),
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// evalConditions maps the operations supported by eval to the conditions they
+// check. The set is deliberately small, eval isn't meant to be a scripting
+// language.
+var evalConditions = map[string]storage.Condition{
+	"ifgt": storage.IfGreater,
+	"iflt": storage.IfLess,
+	"ifeq": storage.IfEqual,
+}
+
+func handleEval(s *session, args []string) string {
+	op, key, operand, value := args[0], args[1], args[2], args[3]
+
+	cond, ok := evalConditions[op]
+	if !ok || key == "" || operand == "" {
+		return "usage: eval ifgt|iflt|ifeq key operand value"
+	}
+
+	if cond != storage.IfEqual {
+		if _, err := strconv.ParseInt(operand, 10, 64); err != nil {
+			return fmt.Sprintf("operand of '%s' must be an integer", op)
+		}
+	}
+
+	if err := s.srv.checkValueSize(value); err != nil {
+		return err.Error()
+	}
+
+	applied, err := s.store.SetIf(key, cond, operand, value)
+	if err != nil {
+		return err.Error()
+	}
+
+	return formatBit(applied)
+}
+
+// checkValueSize checks that the value isn't longer than the max value size.
+// Every write command storing a value given by the client checks it, so that
+// the limit applies uniformly.
+func (srv *Server) checkValueSize(value string) error {
+	return srv.checkValueLen(len(value))
+}
+
+// checkValueLen checks the length of a value like checkValueSize does, for
+// values which aren't given as is, such as restored ones.
+func (srv *Server) checkValueLen(n int) error {
+	if int64(n) > srv.opts.MaxValueSize {
+		return fmt.Errorf("value is too long, max allowed length is %d bytes", srv.opts.MaxValueSize)
+	}
+	return nil
+}
+
+// parseDuration parses a non-negative integer number of units.
+func parseDuration(s string, unit time.Duration) (time.Duration, error) {
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > int64(math.MaxInt64/unit) {
+		return 0, fmt.Errorf("duration out of range")
+	}
+
+	return time.Duration(n) * unit, nil
+}
+
+func handleDebug(s *session, args []string) string {
+	if !s.srv.opts.Debug {
+		return "debug commands are disabled, restart the server with -debug to enable them"
+	}
+
+	subcommand, arg := args[0], args[1]
+
+	switch subcommand {
+	case "sleep":
+		ms, err := strconv.ParseUint(arg, 10, 32)
+		if err != nil {
+			return fmt.Sprintf("invalid duration '%s', expected milliseconds", arg)
+		}
+
+		// only this connection's handler is blocked, the storage keeps serving
+		time.Sleep(time.Duration(ms) * time.Millisecond)
+
+		return "ok"
+	default:
+		return fmt.Sprintf("unknown debug subcommand '%s'", subcommand)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package server
+
+import "net"
+
+// setBacklog changes the accept backlog of the listener, which is only
+// supported on unix systems.
+func setBacklog(listener net.Listener, backlog int) error {
+	return errBacklogUnsupported
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// setBacklog changes the accept backlog of the listener. Go listens with the
+// system default backlog and doesn't let it be configured, but calling listen
+// again on a listening socket updates its backlog.
+func setBacklog(listener net.Listener, backlog int) error {
+	sc, ok := listener.(syscall.Conn)
+	if !ok {
+		return errBacklogUnsupported
+	}
+
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var listenErr error
+	if err := rc.Control(func(fd uintptr) {
+		listenErr = syscall.Listen(int(fd), backlog)
+	}); err != nil {
+		return err
+	}
+
+	return listenErr
+}
@@ -0,0 +1,231 @@
+package server
+
+import (
+	"strings"
+	"time"
+
+	"github.com/eqld/carrot/storage"
+)
+
+// namespaceSeparator separates the namespace from the keys of a namespaced
+// connection. Namespace names can't contain it, or the keys of a namespace
+// could reach into another one.
+const namespaceSeparator = ":"
+
+// namespacedStore confines a connection to the keys starting with its prefix.
+// It implements every method explicitly rather than embedding the Store, so
+// that a method added to the Store can't bypass the prefix unnoticed.
+type namespacedStore struct {
+	store  storage.Store
+	prefix string
+}
+
+func newNamespacedStore(store storage.Store, namespace string) *namespacedStore {
+	return &namespacedStore{
+		store:  store,
+		prefix: namespace + namespaceSeparator,
+	}
+}
+
+func (n *namespacedStore) keys(keys []string) []string {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = n.prefix + key
+	}
+	return prefixed
+}
+
+// escapePattern escapes the characters special to patterns, so that the
+// resulting pattern matches s literally.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (n *namespacedStore) Get(key string) (string, bool, error) {
+	return n.store.Get(n.prefix + key)
+}
+
+func (n *namespacedStore) GetUnsafe(key string) ([]byte, bool, error) {
+	return n.store.GetUnsafe(n.prefix + key)
+}
+
+func (n *namespacedStore) GetChecksum(key string) (string, uint32, bool, error) {
+	return n.store.GetChecksum(n.prefix + key)
+}
+
+func (n *namespacedStore) GetWithTTL(key string) (string, time.Duration, bool, error) {
+	return n.store.GetWithTTL(n.prefix + key)
+}
+
+func (n *namespacedStore) TTLs(keys []string) []time.Duration {
+	return n.store.TTLs(n.keys(keys))
+}
+
+func (n *namespacedStore) Scan(prefix, after string, count int) ([]storage.KeyValue, bool) {
+	// an empty after starts the scan, which every prefixed key sorts after
+	if after != "" {
+		after = n.prefix + after
+	}
+
+	pairs, more := n.store.Scan(n.prefix+prefix, after, count)
+	for i := range pairs {
+		pairs[i].Key = strings.TrimPrefix(pairs[i].Key, n.prefix)
+	}
+
+	return pairs, more
+}
+
+func (n *namespacedStore) GetDefault(key, def string) (string, bool, error) {
+	return n.store.GetDefault(n.prefix+key, def)
+}
+
+func (n *namespacedStore) Set(key, value string) error {
+	return n.store.Set(n.prefix+key, value)
+}
+
+func (n *namespacedStore) RenameNX(src, dst string) (bool, bool) {
+	return n.store.RenameNX(n.prefix+src, n.prefix+dst)
+}
+
+func (n *namespacedStore) SetTagged(key, value, tag string) error {
+	return n.store.SetTagged(n.prefix+key, value, n.prefix+tag)
+}
+
+func (n *namespacedStore) DelTag(tag string) int {
+	return n.store.DelTag(n.prefix + tag)
+}
+
+func (n *namespacedStore) DelPattern(pattern string) (int, error) {
+	return n.store.DelPattern(escapePattern(n.prefix) + pattern)
+}
+
+func (n *namespacedStore) CountPattern(pattern string) (int, error) {
+	return n.store.CountPattern(escapePattern(n.prefix) + pattern)
+}
+
+func (n *namespacedStore) CountTag(tag string) int {
+	return n.store.CountTag(n.prefix + tag)
+}
+
+func (n *namespacedStore) ExpireTag(tag string, ttl time.Duration) int {
+	return n.store.ExpireTag(n.prefix+tag, ttl)
+}
+
+func (n *namespacedStore) GetSetEx(key, value string, ttl time.Duration) (string, bool, error) {
+	return n.store.GetSetEx(n.prefix+key, value, ttl)
+}
+
+func (n *namespacedStore) SetChanged(key, value, tag string) (bool, error) {
+	if tag != "" {
+		tag = n.prefix + tag
+	}
+	return n.store.SetChanged(n.prefix+key, value, tag)
+}
+
+func (n *namespacedStore) SetKeepTTL(key, value, tag string) (bool, error) {
+	if tag != "" {
+		tag = n.prefix + tag
+	}
+	return n.store.SetKeepTTL(n.prefix+key, value, tag)
+}
+
+func (n *namespacedStore) Del(key string) bool {
+	return n.store.Del(n.prefix + key)
+}
+
+func (n *namespacedStore) Unlink(key string) bool {
+	return n.store.Unlink(n.prefix + key)
+}
+
+func (n *namespacedStore) ZAdd(key string, score float64, member string) (bool, error) {
+	return n.store.ZAdd(n.prefix+key, score, member)
+}
+
+func (n *namespacedStore) ZScore(key, member string) (float64, bool, error) {
+	return n.store.ZScore(n.prefix+key, member)
+}
+
+func (n *namespacedStore) ZRange(key string, start, stop int) ([]storage.ScoredMember, error) {
+	return n.store.ZRange(n.prefix+key, start, stop)
+}
+
+func (n *namespacedStore) ZRangeByScore(key string, min, max storage.ScoreBound, offset, count int) ([]storage.ScoredMember, error) {
+	return n.store.ZRangeByScore(n.prefix+key, min, max, offset, count)
+}
+
+func (n *namespacedStore) SetBit(key string, offset uint64, bit bool) (bool, error) {
+	return n.store.SetBit(n.prefix+key, offset, bit)
+}
+
+func (n *namespacedStore) GetBit(key string, offset uint64) (bool, error) {
+	return n.store.GetBit(n.prefix+key, offset)
+}
+
+func (n *namespacedStore) GetRange(key string, start, end int) (string, bool, error) {
+	return n.store.GetRange(n.prefix+key, start, end)
+}
+
+func (n *namespacedStore) BitCount(key string, start, end int) (int, error) {
+	return n.store.BitCount(n.prefix+key, start, end)
+}
+
+func (n *namespacedStore) PFAdd(key string, elements []string) (bool, error) {
+	return n.store.PFAdd(n.prefix+key, elements)
+}
+
+func (n *namespacedStore) PFCount(keys []string) (uint64, error) {
+	return n.store.PFCount(n.keys(keys))
+}
+
+func (n *namespacedStore) PFMerge(dest string, sources []string) error {
+	return n.store.PFMerge(n.prefix+dest, n.keys(sources))
+}
+
+func (n *namespacedStore) MemoryUsage(key string) (int, bool) {
+	return n.store.MemoryUsage(n.prefix + key)
+}
+
+func (n *namespacedStore) SetIf(key string, cond storage.Condition, operand, value string) (bool, error) {
+	return n.store.SetIf(n.prefix+key, cond, operand, value)
+}
+
+func (n *namespacedStore) SetNE(key, value string) (bool, error) {
+	return n.store.SetNE(n.prefix+key, value)
+}
+
+func (n *namespacedStore) IncrWithTTL(key string, ttl time.Duration) (int64, error) {
+	return n.store.IncrWithTTL(n.prefix+key, ttl)
+}
+
+func (n *namespacedStore) IncrCap(key string, max int64) (int64, bool, error) {
+	return n.store.IncrCap(n.prefix+key, max)
+}
+
+func (n *namespacedStore) Dump(key string) ([]byte, bool) {
+	return n.store.Dump(n.prefix + key)
+}
+
+func (n *namespacedStore) Restore(key string, ttl time.Duration, blob []byte) error {
+	return n.store.Restore(n.prefix+key, ttl, blob)
+}
+
+func (n *namespacedStore) Object(key string) (storage.ObjectInfo, bool) {
+	return n.store.Object(n.prefix + key)
+}
+
+// Stats returns the statistics of the underlying store, which aren't broken
+// down by namespace.
+func (n *namespacedStore) Stats() storage.Stats {
+	return n.store.Stats()
+}
+
+// Close does nothing, the underlying store is shared by all connections and
+// outlives this one.
+func (n *namespacedStore) Close() {}
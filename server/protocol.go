@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strings"
+	"time"
+)
+
+// Protocol negotiation.
+//
+// Right after connecting, a client may open a handshake by sending the
+// handshakeMarker byte followed by a single byte holding the highest protocol
+// version it supports. The server replies with a single byte holding the
+// negotiated version, the lower of the client's version and protocolMax, and
+// both sides speak that version from then on. A client announcing version 0
+// is disconnected.
+//
+// A client which doesn't open the handshake speaks the line protocol, version
+// 1, and receives no handshake reply. The handshake is opened by the client
+// rather than the server so that line protocol clients predating it keep
+// working unchanged: the marker byte never starts a line protocol command.
+//
+// Versions:
+//
+//  1. Line protocol: commands are lines terminated by either '\n' or "\r\n",
+//     each response is framed as its length in 4 little-endian bytes
+//     followed by the response. Only the terminator is stripped from a line,
+//     other whitespace is kept as sent. The command name ends at the first
+//     space. Arguments are separated by runs of whitespace, except for the
+//     commands listed in lineArgCounts: their arguments are separated by
+//     single spaces, and the last one takes the rest of the line verbatim,
+//     including any leading or trailing spaces.
+//  2. Framed protocol: each command is sent as the number of its words, the
+//     command name included, followed by every word framed as its length
+//     and the word itself, all numbers being 4 little-endian bytes. Words may
+//     hold any bytes. Responses are framed as in the line protocol.
+//  3. Tagged protocol: each command is sent as in the framed protocol, but
+//     preceded by a request ID of 4 bytes chosen by the client, which the
+//     server echoes before the response to the command, so that a client may
+//     have many requests outstanding and match their responses by ID. The
+//     IDs are opaque to the server and need not be unique.
+//
+// Commands may be pipelined: a connection's commands are read and processed
+// one at a time in the order they were sent, and each command is applied to
+// the storage before its response is sent. A command therefore observes the
+// writes of every command sent before it on the same connection, such as a
+// get following a set of the same key, whether or not their responses have
+// been read yet. This holds over the tagged protocol too, whose responses are
+// currently sent in request order as well, yet clients should match them by
+// ID rather than rely on their order. The exception is a command which timed
+// out as set by -command-timeout: it completes in the background, possibly
+// after the commands following it.
+//
+// Once a connection has sent 'timing on', each response is followed by the
+// time the server spent processing the command, in microseconds as 8
+// little-endian bytes, until it sends 'timing off'. The setting applies from
+// the response following the one to the timing command.
+//
+// Over the framed and tagged protocols, a connection may send 'multibulk on'
+// to make the commands replying several elements, such as zrange, send them
+// as a multi-bulk response rather than joined with newlines, so that elements
+// may hold newlines or any other bytes. A multi-bulk response is framed as
+// multiBulkMarker in place of the length of a response, followed by the
+// number of elements and every element framed as its length, all numbers
+// being 4 little-endian bytes. Other responses are framed as usual, so a
+// client tells them apart by the marker. The setting applies from the
+// response following the one to the multibulk command.
+//
+// A command prefixed with noreply, such as 'noreply set key value', is handled
+// as usual but no response is sent to it, not even an error, so that a client
+// loading data can spare the responses it doesn't need. The client must not
+// wait for a response to such commands, over the tagged protocol their
+// request IDs are never echoed.
+//
+// When the server closes a connection on its own, because it was idle for
+// too long or because the server shuts down, it first sends a message stating
+// the reason, so that the client can tell it apart from a network failure.
+// The message is framed as closeMarker in place of the length of a response,
+// followed by the reason framed as its length, both in 4 little-endian bytes.
+// Over the tagged protocol it is preceded by closeRequestID as request ID,
+// which doesn't answer any request. The message is never sent over the line
+// protocol, whose clients predating it would read the marker as the length
+// of a response. The message is best effort: it is skipped if the server is
+// in the middle of sending a response.
+const (
+	handshakeMarker = 0x00
+
+	protocolLine   = 1
+	protocolFramed = 2
+	protocolTagged = 3
+	protocolMax    = protocolTagged
+
+	// multiBulkMarker stands for the length of multi-bulk responses and
+	// closeMarker for the length of the message sent before the server
+	// closes a connection, the length of other responses must stay below
+	// both. closeRequestID is the request ID of that message.
+	multiBulkMarker = math.MaxUint32
+	closeMarker     = math.MaxUint32 - 1
+	closeRequestID  = math.MaxUint32
+
+	// closeReasonTimeout bounds the time spent sending the reason why a
+	// connection is closed to a client which doesn't read it
+	closeReasonTimeout = time.Second
+
+	// maxFramedArgs bounds the number of words of a framed command, so that a
+	// bogus count can't make the server allocate arbitrary amounts of memory
+	maxFramedArgs = 1 << 20
+)
+
+// lineArgCounts maps the commands whose last argument takes the rest of the
+// line in the line protocol to their number of arguments, so that the last
+// argument may contain spaces.
+var lineArgCounts = map[string]int{
+	"namespace":  1,
+	"set":        2,
+	"setne":      2,
+	"get":        1,
+	"getcrc":     1,
+	"getdefault": 2,
+	"del":        1,
+	"unlink":     1,
+	"delpattern": 1,
+	"zadd":       3,
+	"zscore":     2,
+	"memory":     2,
+	"object":     1,
+	"eval":       4,
+	"dump":       1,
+	"debug":      2,
+}
+
+// negotiate performs the handshake if the client opens one, and returns the
+// protocol version of the connection.
+func negotiate(conn net.Conn, reader *bufio.Reader) (byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return 0, err
+	}
+	if first[0] != handshakeMarker {
+		return protocolLine, nil
+	}
+
+	handshake := make([]byte, 2)
+	if _, err := io.ReadFull(reader, handshake); err != nil {
+		return 0, err
+	}
+
+	version := handshake[1]
+	if version == 0 {
+		return 0, fmt.Errorf("client announced protocol version 0")
+	}
+	if version > protocolMax {
+		version = protocolMax
+	}
+
+	if _, err := conn.Write([]byte{version}); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// readCommand reads the next command along with its arguments in the protocol
+// of the given version.
+func readCommand(reader *bufio.Reader, version byte) (string, []string, error) {
+	if version >= protocolFramed {
+		words, err := readFramedCommand(reader)
+		if err != nil || len(words) == 0 {
+			return "", nil, err
+		}
+
+		return words[0], words[1:], nil
+	}
+
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", nil, err
+	}
+
+	line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+	command, args := splitLine(line)
+
+	return command, args, nil
+}
+
+// splitLine splits the command line of the line protocol into the command
+// name and its arguments. The command following noreply is split as if it
+// were sent alone, so that its last argument may contain spaces as well.
+// The key of a get can't be told apart from a following withttl, so a key
+// ending with ' withttl' is split into the key and withttl, before the
+// arguments are checked against the ACLs.
+func splitLine(line string) (string, []string) {
+	command, rest, _ := strings.Cut(line, " ")
+	if command == "noreply" && rest != "" {
+		inner, args := splitLine(rest)
+		return command, append([]string{inner}, args...)
+	}
+	if key, ok := strings.CutSuffix(rest, " withttl"); ok && command == "get" {
+		return command, []string{key, "withttl"}
+	}
+	if n, ok := lineArgCounts[command]; ok {
+		return command, strings.SplitN(rest, " ", n)
+	}
+
+	return command, strings.Fields(rest)
+}
+
+// readTaggedCommand reads the next command of the tagged protocol along with
+// its arguments, and returns its request ID as received so that it can be
+// echoed before the response.
+func readTaggedCommand(reader *bufio.Reader) ([]byte, string, []string, error) {
+	id := make([]byte, 4)
+	if _, err := io.ReadFull(reader, id); err != nil {
+		return nil, "", nil, err
+	}
+
+	command, args, err := readCommand(reader, protocolFramed)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return id, command, args, err
+}
+
+func readFramedCommand(reader *bufio.Reader) ([]string, error) {
+	count, err := readUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+	if count > maxFramedArgs {
+		return nil, fmt.Errorf("command has %d words, at most %d are allowed", count, maxFramedArgs)
+	}
+
+	words := make([]string, 0, count)
+	for i := uint32(0); i < count; i++ {
+		size, err := readUint32(reader)
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// the word is copied as it arrives rather than into a buffer sized
+		// upfront, so that a bogus size can't exhaust memory
+		var word strings.Builder
+		if _, err := io.CopyN(&word, reader, int64(size)); err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return nil, err
+		}
+
+		words = append(words, word.String())
+	}
+
+	return words, nil
+}
+
+func readUint32(reader *bufio.Reader) (uint32, error) {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(reader, b); err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint32(b), nil
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCommandLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		command string
+		args    []string
+	}{
+		{"get k\n", "get", []string{"k"}},
+		{"get k\r\n", "get", []string{"k"}},
+		{"get  k\n", "get", []string{" k"}},
+		{"get k \r\n", "get", []string{"k "}},
+		{"get k\r\r\n", "get", []string{"k\r"}},
+		{"set k v\r\n", "set", []string{"k", "v"}},
+		{"set k  v  \n", "set", []string{"k", " v  "}},
+		{"set k a b\r\n", "set", []string{"k", "a b"}},
+		{"mttl  a   b \n", "mttl", []string{"a", "b"}},
+		{"ping\r\n", "ping", []string{}},
+		{"noreply set k  v \r\n", "noreply", []string{"set", "k", " v "}},
+	}
+
+	for _, test := range tests {
+		reader := bufio.NewReader(strings.NewReader(test.line))
+
+		command, args, err := readCommand(reader, protocolLine)
+		if err != nil {
+			t.Errorf("readCommand(%q) failed: %v", test.line, err)
+			continue
+		}
+		if command != test.command || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("readCommand(%q) = %q, %q, want %q, %q", test.line, command, args, test.command, test.args)
+		}
+	}
+}
+
+func TestSplitLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		command string
+		args    []string
+	}{
+		{"get k", "get", []string{"k"}},
+		{"get  k", "get", []string{" k"}},
+		{"get k ", "get", []string{"k "}},
+		{"set k  v ", "set", []string{"k", " v "}},
+		{"getdefault k d e", "getdefault", []string{"k", "d e"}},
+		{"get k withttl", "get", []string{"k", "withttl"}},
+		{"get a b withttl", "get", []string{"a b", "withttl"}},
+		{"mttl  a\tb  ", "mttl", []string{"a", "b"}},
+		{"ping", "ping", []string{}},
+	}
+
+	for _, test := range tests {
+		command, args := splitLine(test.line)
+		if command != test.command || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("splitLine(%q) = %q, %q, want %q, %q", test.line, command, args, test.command, test.args)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync/atomic"
+)
+
+// serveReadiness answers HTTP readiness checks at /ready on the address,
+// reporting 503 Service Unavailable unless ready is set. Liveness is checked
+// with the ping command. The returned server is to be closed once done.
+func serveReadiness(address string, ready *atomic.Bool) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+
+		fmt.Fprintln(w, "ready")
+	})
+
+	log.Printf("serving readiness checks on %s\n", address)
+
+	readiness := &http.Server{Handler: mux}
+	go func() {
+		if err := readiness.Serve(listener); err != http.ErrServerClosed {
+			log.Printf("stopped serving readiness checks: %v\n", err)
+		}
+	}()
+
+	return readiness, nil
+}
@@ -0,0 +1,234 @@
+package server_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/eqld/carrot/carrottest"
+	"github.com/eqld/carrot/client"
+	"github.com/eqld/carrot/server"
+)
+
+// TestPipelinedGetSeesSet checks that a get pipelined right behind a set of
+// the same key observes the set, see the pipelining guarantee in protocol.go.
+func TestPipelinedGetSeesSet(t *testing.T) {
+	address, cleanup := carrottest.NewServer(server.Options{})
+	defer cleanup()
+
+	c, err := client.DialTagged(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	const pairs = 1000
+
+	// every set and get is sent before any response is read
+	for i := 0; i < pairs; i++ {
+		key, value := fmt.Sprintf("k%d", i), fmt.Sprintf("v%d", i)
+		if err := c.Send(uint32(2*i), "set", key, value); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Send(uint32(2*i+1), "get", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2*pairs; i++ {
+		id, response, err := c.Receive()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := "ok"
+		if id%2 == 1 {
+			want = fmt.Sprintf("found: v%d", id/2)
+		}
+		if response != want {
+			t.Fatalf("response to request %d is %q, want %q", id, response, want)
+		}
+	}
+}
+
+// TestLargeValueRoundTrips checks that a value large enough to be sent
+// without being copied comes back byte for byte, with and without timing.
+func TestLargeValueRoundTrips(t *testing.T) {
+	address, cleanup := carrottest.NewServer(server.Options{})
+	defer cleanup()
+
+	value := make([]byte, 20<<20)
+	for i := range value {
+		value[i] = byte(i * 7)
+	}
+
+	for _, timing := range []string{"off", "on"} {
+		t.Run("timing "+timing, func(t *testing.T) {
+			c, err := client.DialFramed(address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			if _, err := c.Call("timing", timing); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.SetBytes("large", value); err != nil {
+				t.Fatal(err)
+			}
+			got, ok, err := c.GetBytes("large")
+			if err != nil || !ok {
+				t.Fatalf("GetBytes returned %v, %v", ok, err)
+			}
+			if !bytes.Equal(got, value) {
+				t.Fatalf("got a value of %d bytes differing from the %d bytes set", len(got), len(value))
+			}
+			if _, timed := c.ServerTime(); timed != (timing == "on") {
+				t.Fatalf("response carried a processing time: %v, want %v", timed, timing == "on")
+			}
+		})
+	}
+}
+
+// TestValueSpacesRoundTrip checks that the leading and trailing spaces of a
+// value are kept, over the line protocol, where the value takes the rest of
+// the line, as well as over the framed protocol.
+func TestValueSpacesRoundTrip(t *testing.T) {
+	address, cleanup := carrottest.NewServer(server.Options{})
+	defer cleanup()
+
+	dials := map[string]func(string) (*client.Client, error){
+		"line":   client.Dial,
+		"framed": client.DialFramed,
+	}
+	values := []string{" hello", "hello ", "  hello  world  ", " ", "\thello\t"}
+
+	for name, dial := range dials {
+		t.Run(name, func(t *testing.T) {
+			c, err := dial(address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			for _, value := range values {
+				if response, err := c.Call("set", "k", value); err != nil || response != "ok" {
+					t.Fatalf("set %q replied %q, %v", value, response, err)
+				}
+
+				response, err := c.Call("get", "k")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := "found: " + value; response != want {
+					t.Errorf("get replied %q after setting %q, want %q", response, value, want)
+				}
+			}
+		})
+	}
+}
+
+// TestNoReplyDoesNotWait checks that Do and Call return without waiting for a
+// response to noreply commands, which the server never sends, and that the
+// commands are carried out.
+func TestNoReplyDoesNotWait(t *testing.T) {
+	address, cleanup := carrottest.NewServer(server.Options{})
+	defer cleanup()
+
+	c, err := client.Dial(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if response, err := c.Do("noreply set a 1"); err != nil || response != "" {
+		t.Fatalf("Do replied %q, %v", response, err)
+	}
+	if response, err := c.Call("noreply", "set", "b", "2"); err != nil || response != "" {
+		t.Fatalf("Call replied %q, %v", response, err)
+	}
+
+	for key, value := range map[string]string{"a": "1", "b": "2"} {
+		response, err := c.Call("get", key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "found: " + value; response != want {
+			t.Errorf("get %s replied %q, want %q", key, response, want)
+		}
+	}
+}
+
+// TestKillIdleSparesBusyConnections checks that client killidle closes the
+// idle connections only, sparing the caller and the connections whose command
+// is still being handled.
+func TestKillIdleSparesBusyConnections(t *testing.T) {
+	address, cleanup := carrottest.NewServer(server.Options{Debug: true})
+	defer cleanup()
+
+	conns := make([]*client.Client, 3)
+	for i := range conns {
+		c, err := client.Dial(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		conns[i] = c
+	}
+	caller, busy, idle := conns[0], conns[1], conns[2]
+
+	slept := make(chan error, 1)
+	go func() {
+		response, err := busy.Call("debug", "sleep", "3000")
+		if err == nil && response != "ok" {
+			err = fmt.Errorf("debug sleep replied %q", response)
+		}
+		slept <- err
+	}()
+
+	time.Sleep(1500 * time.Millisecond)
+
+	if response, err := caller.Call("client", "killidle", "1"); err != nil || response != "1" {
+		t.Fatalf("client killidle replied %q, %v, want 1", response, err)
+	}
+	if err := <-slept; err != nil {
+		t.Fatalf("the busy connection was closed: %v", err)
+	}
+	if _, err := idle.Call("ping"); err == nil {
+		t.Fatal("the idle connection wasn't closed")
+	}
+}
+
+// BenchmarkReadBufferSize measures the throughput of sets of values of
+// various lengths with read buffers of various sizes, which the default read
+// buffer size is picked from. Responses aren't buffered, see sendFrame, so
+// only the read side has a buffer to size.
+func BenchmarkReadBufferSize(b *testing.B) {
+	for _, valueLen := range []int{128, 16 << 10, 1 << 20} {
+		value := bytes.Repeat([]byte("v"), valueLen)
+
+		for _, size := range []int{4 << 10, 16 << 10, 64 << 10, 256 << 10} {
+			b.Run(fmt.Sprintf("value=%d/buffer=%d", valueLen, size), func(b *testing.B) {
+				address, cleanup := carrottest.NewServer(server.Options{ReadBufferSize: size})
+				defer cleanup()
+
+				c, err := client.DialFramed(address)
+				if err != nil {
+					b.Fatal(err)
+				}
+				defer c.Close()
+
+				b.SetBytes(int64(valueLen))
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					if err := c.SetBytes("k", value); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
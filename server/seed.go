@@ -0,0 +1,51 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// loadSeedFile stores the keys listed in the seed file and returns their
+// number. Every line of the file holds a key and its value separated by the
+// first '=', empty lines and lines starting with '#' are skipped.
+func (srv *Server) loadSeedFile(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	loaded := 0
+
+	for n := 1; ; n++ {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return loaded, err
+		}
+
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+
+		if line != "" && !strings.HasPrefix(line, "#") {
+			key, value, ok := strings.Cut(line, "=")
+			if !ok || key == "" {
+				return loaded, fmt.Errorf("%s:%d: expected 'key=value'", path, n)
+			}
+			if err := srv.checkValueSize(value); err != nil {
+				return loaded, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+
+			if err := srv.store.Set(key, value); err != nil {
+				return loaded, fmt.Errorf("%s:%d: %v", path, n, err)
+			}
+			loaded++
+		}
+
+		if err == io.EOF {
+			return loaded, nil
+		}
+	}
+}
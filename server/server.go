@@ -0,0 +1,563 @@
+// Package server implements the carrot server, which serves a storage.Store
+// to clients over the protocols described in protocol.go. It is run by the
+// carrot command and can be embedded into other programs.
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/eqld/carrot/storage"
+)
+
+var errBacklogUnsupported = errors.New("configuring the listen backlog is not supported on this platform")
+
+var errUserTimeoutUnsupported = errors.New("configuring the TCP user timeout is not supported on this platform")
+
+// ErrServerClosed is returned by Serve once the Server is closed.
+var ErrServerClosed = errors.New("server closed")
+
+const (
+	// defaultReadBufferSize is the size of the buffer commands are read
+	// through unless configured. BenchmarkReadBufferSize shows no difference
+	// between sizes for small values, while 16 KiB sets values of 16 KiB and
+	// more a few percent faster than 4 KiB does. 64 KiB gains another 10 to
+	// 20% on values of a megabyte, which isn't worth four times the memory
+	// per connection by default, such workloads can raise it.
+	//
+	// Responses go without a write buffer: sendFrame and sendMulti build
+	// each response into a single write, or write large values straight from
+	// the strings, so a buffer would only add a copy.
+	defaultReadBufferSize = 16 << 10
+)
+
+// Options configure a Server. The zero value of every field is its default.
+type Options struct {
+	// Addresses are the addresses Serve listens on, see Listen. They are
+	// ignored by New, whose Server serves the listeners it is given.
+	Addresses []string
+	// ReadinessAddress is the host and port Serve answers HTTP readiness
+	// checks on at /ready, disabled if empty.
+	ReadinessAddress string
+	// Storage configures the Store served by the Server.
+	Storage storage.Options
+	// MaxValueSize bounds the length in bytes of the values stored by write
+	// commands, math.MaxUint32 being both the default and the max.
+	MaxValueSize int64
+	// ReadBufferSize is the size in bytes of the buffer commands are read
+	// through, 16 KiB by default.
+	ReadBufferSize int
+	// ListenBacklog is the size of the queue of connections waiting to be
+	// accepted, the system default if 0. The server logs when it finds the
+	// queue full, which is only detected on Linux.
+	ListenBacklog int
+	// TCPUserTimeout is the time transmitted data may stay unacknowledged
+	// before a connection is closed, disabled if 0. It is only supported on
+	// Linux.
+	TCPUserTimeout time.Duration
+	// SlowWarnThreshold makes every command taking longer than it to handle
+	// log a warning, disabled if 0.
+	SlowWarnThreshold time.Duration
+	// CommandTimeout bounds the time waited for the commands which may be
+	// slow, such as delpattern, disabled if 0.
+	CommandTimeout time.Duration
+	// MaxQueueDepth is the number of commands pending on the storage above
+	// which new ones are rejected, unlimited if 0.
+	MaxQueueDepth int64
+	// ACLFile is the path of the file defining the users connections have to
+	// authenticate as, see loadACLFile. Anyone may run any command if empty.
+	ACLFile string
+	// SeedFile is the path of a file of 'key=value' lines to populate the
+	// storage with, see loadSeedFile.
+	SeedFile string
+	// AllowDelPattern enables the delpattern command.
+	AllowDelPattern bool
+	// Debug enables the debug commands.
+	Debug bool
+	// BuildInfo is reported by the version command, as 'name:value' lines.
+	BuildInfo string
+}
+
+// Server serves a Store to the connections accepted by its listeners.
+type Server struct {
+	opts  Options
+	store storage.Store
+	// acl maps user names to users once loaded from Options.ACLFile,
+	// connections then have to authenticate as one of them with the auth
+	// command. It is nil if ACLs are disabled.
+	acl map[string]*aclUser
+	// clients tracks the connections served by the server
+	clients *clientList
+	// queueDepth counts the commands on the storage being handled, most of
+	// which wait for the storage goroutine to serve them, across connections
+	queueDepth atomic.Int64
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	closed    bool
+	// handlers tracks the goroutines serving connections, which Close waits
+	// for before closing the store
+	handlers sync.WaitGroup
+}
+
+// New creates a Server and its Store, populated from the seed file if any.
+func New(opts Options) (*Server, error) {
+	if opts.MaxValueSize == 0 {
+		opts.MaxValueSize = math.MaxUint32
+	}
+	if opts.ReadBufferSize == 0 {
+		opts.ReadBufferSize = defaultReadBufferSize
+	}
+
+	switch {
+	case opts.MaxValueSize < 0 || opts.MaxValueSize > math.MaxUint32:
+		return nil, fmt.Errorf("max value size must be between 1 and %d bytes", uint64(math.MaxUint32))
+	case opts.ReadBufferSize < 0:
+		return nil, fmt.Errorf("read buffer size must be positive")
+	case opts.TCPUserTimeout > 0 && !userTimeoutSupported:
+		return nil, errUserTimeoutUnsupported
+	}
+
+	srv := &Server{
+		opts:      opts,
+		clients:   newClientList(),
+		listeners: make(map[net.Listener]struct{}),
+	}
+
+	if opts.ACLFile != "" {
+		users, err := loadACLFile(opts.ACLFile)
+		if err != nil {
+			return nil, err
+		}
+		srv.acl = users
+
+		log.Printf("loaded %d users from %s\n", len(users), opts.ACLFile)
+	}
+
+	srv.store = storage.NewWithOptions(opts.Storage)
+
+	if opts.SeedFile != "" {
+		loaded, err := srv.loadSeedFile(opts.SeedFile)
+		if err != nil {
+			srv.store.Close()
+			return nil, err
+		}
+
+		log.Printf("loaded %d keys from %s\n", loaded, opts.SeedFile)
+	}
+
+	return srv, nil
+}
+
+// Listen listens on the address, which is either a TCP host and port or
+// 'unix:' followed by the path of a Unix socket.
+func Listen(address string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		return net.Listen("unix", path)
+	}
+
+	return net.Listen("tcp", address)
+}
+
+// Serve serves the connections accepted by the listener until it fails for
+// good, or until the Server is closed in which case it returns
+// ErrServerClosed. A Server may serve several listeners at once, all of them
+// feeding the same Store.
+func (srv *Server) Serve(listener net.Listener) error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		return ErrServerClosed
+	}
+	srv.listeners[listener] = struct{}{}
+	srv.mu.Unlock()
+
+	if srv.opts.ListenBacklog > 0 {
+		if err := setBacklog(listener, srv.opts.ListenBacklog); err != nil {
+			return err
+		}
+	}
+
+	err := srv.acceptConns(listener)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	delete(srv.listeners, listener)
+	if srv.closed {
+		return ErrServerClosed
+	}
+
+	return err
+}
+
+// Close closes the listeners and the connections of the Server, then closes
+// its Store once the commands being handled are done.
+func (srv *Server) Close() error {
+	srv.mu.Lock()
+	if srv.closed {
+		srv.mu.Unlock()
+		return nil
+	}
+	srv.closed = true
+
+	var err error
+	for listener := range srv.listeners {
+		if closeErr := listener.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	srv.mu.Unlock()
+
+	srv.clients.closeAll("server shutting down")
+	srv.handlers.Wait()
+	srv.store.Close()
+
+	return err
+}
+
+// Serve creates a Server configured by the options and serves the connections
+// accepted on every address of Options.Addresses until the context is
+// cancelled, at which point it closes the Server as Close does and returns
+// nil. It returns an error if the Server can't be created, if it can't listen
+// on an address, or once a listener fails for good, the Server being closed
+// as well.
+func Serve(ctx context.Context, opts Options) error {
+	if len(opts.Addresses) == 0 {
+		return errors.New("no address to listen on")
+	}
+
+	srv, err := New(opts)
+	if err != nil {
+		return err
+	}
+	defer srv.Close()
+
+	// the listeners are closed by the Server once it serves them, which it
+	// may not have started doing when returning
+	var listeners []net.Listener
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+
+	for _, address := range opts.Addresses {
+		listener, err := Listen(address)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("listening %s\n", address)
+
+		listeners = append(listeners, listener)
+	}
+
+	var ready atomic.Bool
+	if opts.ReadinessAddress != "" {
+		readiness, err := serveReadiness(opts.ReadinessAddress, &ready)
+		if err != nil {
+			return err
+		}
+		defer readiness.Close()
+	}
+
+	// every listener feeds the same storage, the first one to fail for good
+	// brings the server down
+	errs := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			errs <- srv.Serve(listener)
+		}(listener)
+	}
+
+	ready.Store(true)
+	defer ready.Store(false)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+		log.Printf("shutting down: %v\n", context.Cause(ctx))
+	}
+
+	ready.Store(false)
+	return srv.Close()
+}
+
+// acceptConns serves the connections accepted by the listener until it fails
+// for good.
+func (srv *Server) acceptConns(listener net.Listener) error {
+	// backoff between retries of temporarily failing accepts, e.g. when the
+	// process runs out of file descriptors
+	var backoff time.Duration
+
+	// last time the accept queue was found full, which is logged at most
+	// once a second
+	var queueFull time.Time
+
+	for {
+		conn, err := listener.Accept()
+		if ne, ok := err.(net.Error); ok && ne.Temporary() {
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
+			}
+
+			log.Printf("failed to accept a connection, retrying in %v: %v\n", backoff, err)
+			time.Sleep(backoff)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		backoff = 0
+
+		// connections arriving while the queue is full are refused or
+		// dropped by the kernel
+		if queued, size, ok := acceptQueue(listener); ok && queued >= size && time.Since(queueFull) >= time.Second {
+			queueFull = time.Now()
+			log.Printf("the accept queue of %s is full with %d connections, new connections may be refused\n", listener.Addr(), queued)
+		}
+
+		if tcpConn, ok := conn.(*net.TCPConn); ok && srv.opts.TCPUserTimeout > 0 {
+			if err := setUserTimeout(tcpConn, srv.opts.TCPUserTimeout); err != nil {
+				log.Printf("failed to set the TCP user timeout of %s: %v\n", conn.RemoteAddr(), err)
+			}
+		}
+
+		// connections accepted while closing are dropped, as Close may be
+		// waiting for the handlers already. Others are registered before
+		// Close can see the server closed, so that it closes them.
+		srv.mu.Lock()
+		if srv.closed {
+			srv.mu.Unlock()
+			conn.Close()
+			continue
+		}
+		client := srv.clients.add(conn)
+		srv.handlers.Add(1)
+		srv.mu.Unlock()
+
+		go func() {
+			defer srv.handlers.Done()
+			srv.handleConn(client)
+		}()
+	}
+}
+
+// session is the state of a client connection.
+type session struct {
+	srv     *Server
+	conn    *clientConn
+	store   storage.Store
+	version byte
+	// namespace is the namespace the connection is confined to, if any, the
+	// store being wrapped accordingly
+	namespace string
+	// timing makes responses carry the time spent processing the command
+	timing bool
+	// changes makes writes acknowledged with 'ok' reply whether they changed
+	// anything instead
+	changes bool
+	// user is the user the connection authenticated as, nil until then
+	user *aclUser
+	// multiBulk makes commands replying several elements send multi-bulk
+	// responses, multi then reports whether the handler of the current
+	// command replied the elements that way
+	multiBulk bool
+	multi     bool
+	elements  []string
+	// noReply reports whether the current command was sent with noreply, so
+	// that its response is dropped
+	noReply bool
+}
+
+// handleConn serves the commands of the connection until it is closed.
+func (srv *Server) handleConn(conn *clientConn) {
+	defer conn.Close()
+
+	reader := bufio.NewReaderSize(conn, srv.opts.ReadBufferSize)
+
+	version, err := negotiate(conn, reader)
+	if err == io.EOF {
+		log.Printf("disconnecting %s\n", conn.RemoteAddr())
+		return
+	}
+	if err != nil {
+		log.Printf("disconnecting %s due to failed protocol negotiation: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	log.Printf("serving %s as client %d over protocol version %d\n", conn.RemoteAddr(), conn.id, version)
+
+	conn.mu.Lock()
+	conn.version = version
+	conn.mu.Unlock()
+
+	s := &session{srv: srv, conn: conn, store: srv.store, version: version}
+
+	for {
+		// id is the request ID to echo in the tagged protocol, nil otherwise
+		var id []byte
+		var command string
+		var args []string
+		if version >= protocolTagged {
+			id, command, args, err = readTaggedCommand(reader)
+		} else {
+			command, args, err = readCommand(reader, version)
+		}
+		if err == io.EOF {
+			log.Printf("disconnecting %s\n", conn.RemoteAddr())
+			return
+		}
+		if reason := conn.closeReason(); reason != "" {
+			log.Printf("disconnected %s: %s\n", conn.RemoteAddr(), reason)
+			return
+		}
+		if err != nil {
+			log.Printf("disconnecting %s due to error: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+
+		conn.touch()
+
+		start := time.Now()
+		// the timing command changes the format of the following responses
+		// only, so that the client knows the format of its response
+		timed := s.timing
+
+		s.multi, s.elements, s.noReply = false, nil, false
+		conn.running.Store(true)
+		message := dispatch(s, command, args)
+		conn.touch()
+		conn.running.Store(false)
+
+		elapsed := time.Since(start)
+		if srv.opts.SlowWarnThreshold > 0 && elapsed > srv.opts.SlowWarnThreshold {
+			warnSlowCommand(conn, command, args, elapsed)
+		}
+
+		if s.noReply {
+			continue
+		}
+
+		var trailer []byte
+		if timed {
+			trailer = binary.LittleEndian.AppendUint64(nil, uint64(elapsed.Microseconds()))
+		}
+		conn.mu.Lock()
+		if s.multi {
+			err = sendMulti(conn, id, s.elements, trailer)
+		} else {
+			err = sendFrame(conn, id, message, trailer)
+		}
+		conn.mu.Unlock()
+		if err != nil {
+			log.Printf("disconnecting %s due to failure while sending a message: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+
+		if command == "quit" {
+			log.Printf("disconnecting %s on quit\n", conn.RemoteAddr())
+			return
+		}
+	}
+}
+
+// warnSlowCommand logs a warning about a command which took the elapsed time
+// to handle. Only the key of commands on the storage is logged, as other
+// arguments may be large values.
+func warnSlowCommand(conn *clientConn, command string, args []string, elapsed time.Duration) {
+	key := ""
+	if spec, ok := commandsByName[command]; ok && spec.flags&flagConnection == 0 && len(args) > 0 {
+		key = args[0]
+	}
+
+	log.Printf("WARN slow command '%s' key '%s' from client %d took %v\n", command, key, conn.id, elapsed)
+}
+
+// sendCopyLimit is the size below which a response is copied behind its
+// length into a single buffer, so that it is sent with a single write. Larger
+// responses are written straight from the message to avoid a copy.
+const sendCopyLimit = 64 << 10
+
+// sendFrame sends the header followed by the message framed as its length in
+// 4 little-endian bytes, and the trailer. The header holds the request ID in
+// the tagged protocol, the trailer the processing time in timing mode.
+func sendFrame(conn net.Conn, header []byte, v string, trailer []byte) error {
+	if len(v) < sendCopyLimit {
+		b := make([]byte, 0, len(header)+4+len(v)+len(trailer))
+		b = append(b, header...)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(v)))
+		b = append(b, v...)
+		b = append(b, trailer...)
+
+		_, err := conn.Write(b)
+		return err
+	}
+
+	// the bytes of the message are only read by the writes, so they can be
+	// shared with the string rather than copied
+	buffers := net.Buffers{
+		binary.LittleEndian.AppendUint32(header, uint32(len(v))),
+		unsafe.Slice(unsafe.StringData(v), len(v)),
+		trailer,
+	}
+
+	_, err := buffers.WriteTo(conn)
+	return err
+}
+
+// sendClose sends the message telling the client why the server closes the
+// connection, see protocol.go.
+func sendClose(conn net.Conn, version byte, reason string) error {
+	var b []byte
+	if version >= protocolTagged {
+		b = binary.LittleEndian.AppendUint32(b, closeRequestID)
+	}
+	b = binary.LittleEndian.AppendUint32(b, closeMarker)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(reason)))
+	b = append(b, reason...)
+
+	_, err := conn.Write(b)
+	return err
+}
+
+// sendMulti sends the header followed by the elements as a multi-bulk
+// response, and the trailer. Elements too large to be copied cheaply are
+// written straight from the strings, like in sendFrame.
+func sendMulti(conn net.Conn, header []byte, elements []string, trailer []byte) error {
+	b := append([]byte(nil), header...)
+	b = binary.LittleEndian.AppendUint32(b, multiBulkMarker)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(elements)))
+
+	var buffers net.Buffers
+	for _, e := range elements {
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(e)))
+		if len(e) < sendCopyLimit {
+			b = append(b, e...)
+			continue
+		}
+
+		buffers = append(buffers, b, unsafe.Slice(unsafe.StringData(e), len(e)))
+		b = nil
+	}
+	buffers = append(buffers, append(b, trailer...))
+
+	_, err := buffers.WriteTo(conn)
+	return err
+}
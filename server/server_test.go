@@ -0,0 +1,193 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// temporaryError is a net.Error reporting a temporary failure, such as the
+// process running out of file descriptors.
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener is a net.Listener whose first Accept fails with a temporary
+// error, the following ones returning the connections sent on conns.
+type flakyListener struct {
+	conns     chan net.Conn
+	failed    bool
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newFlakyListener() *flakyListener {
+	return &flakyListener{
+		conns:  make(chan net.Conn, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	if !l.failed {
+		l.failed = true
+		return nil, temporaryError{}
+	}
+
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *flakyListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *flakyListener) Addr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+func TestServeRetriesTemporaryAcceptErrors(t *testing.T) {
+	srv, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener := newFlakyListener()
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(listener)
+	}()
+
+	serverConn, clientConn := net.Pipe()
+	listener.conns <- serverConn
+	clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := clientConn.Write([]byte("ping\n")); err != nil {
+		t.Fatalf("failed to send ping: %v", err)
+	}
+	response := make([]byte, 8)
+	if _, err := io.ReadFull(clientConn, response); err != nil {
+		t.Fatalf("failed to read the response to ping: %v", err)
+	}
+	if size := binary.LittleEndian.Uint32(response); size != 4 || string(response[4:]) != "pong" {
+		t.Fatalf("got response %q, want pong", response)
+	}
+
+	clientConn.Close()
+	srv.Close()
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v, want ErrServerClosed", err)
+	}
+}
+
+// TestCloseWhileDialing checks that Close closes the connections accepted
+// while it runs rather than waiting for their clients to leave, clients here
+// never leaving on their own.
+func TestCloseWhileDialing(t *testing.T) {
+	srv, err := New(Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(listener)
+
+	var mu sync.Mutex
+	var conns []net.Conn
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	stop := make(chan struct{})
+	var dialers sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		dialers.Add(1)
+		go func() {
+			defer dialers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				conn, err := net.Dial("tcp", listener.Addr().String())
+				if err != nil {
+					return
+				}
+				mu.Lock()
+				conns = append(conns, conn)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(closed)
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close waited for connections accepted while closing")
+	}
+
+	close(stop)
+	dialers.Wait()
+}
+
+// TestTimedOutCommandKeepsQueueSlot checks that a command on the storage which
+// timed out keeps counting in the queue depth until its handler returns, as
+// it still runs in the background.
+func TestTimedOutCommandKeepsQueueSlot(t *testing.T) {
+	srv, err := New(Options{CommandTimeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	unblock := make(chan struct{})
+	commandsByName["blocked"] = &commandSpec{"blocked", 0, 0, flagWrite | flagSlow, "blocked", func(s *session, args []string) string {
+		<-unblock
+		return "ok"
+	}}
+	defer delete(commandsByName, "blocked")
+
+	s := &session{srv: srv, store: srv.store}
+	if response := dispatch(s, "blocked", nil); response != "command timed out" {
+		t.Fatalf("dispatch replied %q, want a timeout", response)
+	}
+	if depth := srv.queueDepth.Load(); depth != 1 {
+		t.Fatalf("queue depth is %d while the command runs, want 1", depth)
+	}
+
+	close(unblock)
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.queueDepth.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the command kept its queue slot after returning")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
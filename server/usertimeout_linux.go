@@ -0,0 +1,36 @@
+//go:build linux
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"time"
+)
+
+// sysTCPUserTimeout is TCP_USER_TIMEOUT from linux/tcp.h, which package
+// syscall doesn't define.
+const sysTCPUserTimeout = 0x12
+
+// userTimeoutSupported reports whether setUserTimeout is supported.
+const userTimeoutSupported = true
+
+// setUserTimeout sets the TCP user timeout of the connection, the maximum
+// time transmitted data may stay unacknowledged before the kernel closes the
+// connection. Together with keepalive probes, which Go enables on accepted
+// connections, it detects peers that vanished without closing the connection.
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var setErr error
+	if err := rc.Control(func(fd uintptr) {
+		setErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, sysTCPUserTimeout, int(timeout.Milliseconds()))
+	}); err != nil {
+		return err
+	}
+
+	return setErr
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package server
+
+import (
+	"net"
+	"time"
+)
+
+// userTimeoutSupported reports whether setUserTimeout is supported. The TCP
+// user timeout is a Linux socket option, elsewhere half-open connections are
+// only detected by the keepalive probes Go enables on accepted connections.
+const userTimeoutSupported = false
+
+// setUserTimeout sets the TCP user timeout of the connection, which is only
+// supported on Linux.
+func setUserTimeout(conn *net.TCPConn, timeout time.Duration) error {
+	return errUserTimeoutUnsupported
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// setBit sets the bit at the offset of the bitmap, growing it with zero bytes
+// as needed, and returns the grown bitmap along with the previous bit. Bits
+// are numbered from the most significant bit of the first byte.
+func setBit(bitmap []byte, offset uint64, bit bool) ([]byte, bool) {
+	i := int(offset / 8)
+	if i >= len(bitmap) {
+		bitmap = append(bitmap, make([]byte, i-len(bitmap)+1)...)
+	}
+
+	mask := byte(0x80) >> (offset % 8)
+	old := bitmap[i]&mask != 0
+
+	if bit {
+		bitmap[i] |= mask
+	} else {
+		bitmap[i] &^= mask
+	}
+
+	return bitmap, old
+}
+
+// getBit returns the bit at the offset of the bitmap, bits beyond its end are
+// zero.
+func getBit(bitmap []byte, offset uint64) bool {
+	i := offset / 8
+	if i >= uint64(len(bitmap)) {
+		return false
+	}
+
+	return bitmap[i]&(byte(0x80)>>(offset%8)) != 0
+}
+
+// bitCount returns the number of set bits in the bytes of the bitmap between
+// start and end, see normalizeRange.
+func bitCount(bitmap []byte, start, end int) int {
+	from, to := normalizeRange(start, end, len(bitmap))
+	b := bitmap[from:to]
+	count := 0
+
+	for len(b) >= 8 {
+		count += bits.OnesCount64(binary.LittleEndian.Uint64(b))
+		b = b[8:]
+	}
+	for _, v := range b {
+		count += bits.OnesCount8(v)
+	}
+
+	return count
+}
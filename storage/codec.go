@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"io"
+	"sync"
+)
+
+// Codec transforms the strings of a Store as they are stored and read back.
+// Every operation storing a string encodes it and every operation reading a
+// string decodes it first, so the transformation is invisible to the callers
+// of the Store, to its Backend and to dumps, which all see the strings as
+// written. Operations updating part of a string, such as SetBit, decode it,
+// update it and encode it again. Codec methods are called by the goroutine
+// serving the Store, a Codec shared by several Stores must be safe for
+// concurrent use.
+type Codec interface {
+	// Encode returns the encoded form of the string to store.
+	Encode(value []byte) []byte
+	// Decode returns the string the stored bytes encode.
+	Decode(encoded []byte) ([]byte, error)
+}
+
+// GzipCodec compresses strings with gzip, trading CPU time on every access
+// for the memory saved on compressible strings.
+type GzipCodec struct{}
+
+// gzip writers and readers allocate large buffers, so they are reused across
+// calls.
+var (
+	gzipWriters sync.Pool
+	gzipReaders sync.Pool
+)
+
+func (GzipCodec) Encode(value []byte) []byte {
+	var buf bytes.Buffer
+
+	w, ok := gzipWriters.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		w = gzip.NewWriter(&buf)
+	}
+	defer gzipWriters.Put(w)
+
+	// writing to a bytes.Buffer never fails
+	w.Write(value)
+	w.Close()
+
+	return buf.Bytes()
+}
+
+func (GzipCodec) Decode(encoded []byte) ([]byte, error) {
+	r, ok := gzipReaders.Get().(*gzip.Reader)
+	if ok {
+		if err := r.Reset(bytes.NewReader(encoded)); err != nil {
+			return nil, ErrCorruptValue
+		}
+	} else {
+		var err error
+		if r, err = gzip.NewReader(bytes.NewReader(encoded)); err != nil {
+			return nil, ErrCorruptValue
+		}
+	}
+	defer gzipReaders.Put(r)
+
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return nil, ErrCorruptValue
+	}
+
+	return value, nil
+}
+
+// Base64Codec stores strings encoded in standard base64.
+type Base64Codec struct{}
+
+func (Base64Codec) Encode(value []byte) []byte {
+	return base64.StdEncoding.AppendEncode(nil, value)
+}
+
+func (Base64Codec) Decode(encoded []byte) ([]byte, error) {
+	value, err := base64.StdEncoding.AppendDecode(nil, encoded)
+	if err != nil {
+		return nil, ErrCorruptValue
+	}
+
+	return value, nil
+}
+
+// decoded returns the value as read by the callers of the Store, decoding the
+// strings stored by a keyspace with a Codec. Other values are returned as is.
+func (ks *keyspace) decoded(value interface{}) (interface{}, error) {
+	b, ok := value.([]byte)
+	if !ok || ks.codec == nil {
+		return value, nil
+	}
+
+	return ks.codec.Decode(b)
+}
@@ -0,0 +1,38 @@
+package storage
+
+import "strconv"
+
+// Condition is a condition on the string stored under a key, checked against
+// an operand.
+type Condition int
+
+const (
+	// IfGreater holds if the stored string is an integer greater than the
+	// operand.
+	IfGreater Condition = iota
+	// IfLess holds if the stored string is an integer less than the operand.
+	IfLess
+	// IfEqual holds if the stored string equals the operand.
+	IfEqual
+)
+
+// holds checks the condition against the stored string.
+func (c Condition) holds(stored []byte, operand string) (bool, error) {
+	if c == IfEqual {
+		return string(stored) == operand, nil
+	}
+
+	n, err := strconv.ParseInt(string(stored), 10, 64)
+	if err != nil {
+		return false, ErrNotInteger
+	}
+	m, err := strconv.ParseInt(operand, 10, 64)
+	if err != nil {
+		return false, ErrNotInteger
+	}
+
+	if c == IfGreater {
+		return n > m, nil
+	}
+	return n < m, nil
+}
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+)
+
+// A dump is laid out as the dump format version, the type of the value, the
+// value itself, and the CRC-32 (IEEE) of all the preceding bytes in 4
+// little-endian bytes.
+//
+// Strings are dumped as is. Sorted sets are dumped as the number of members,
+// followed by each member as its length, the member itself and its score in 8
+// little-endian bytes, with lengths and counts as unsigned varints. HyperLogLogs
+// are dumped as their registers.
+const (
+	dumpVersion = 1
+
+	dumpString      = 1
+	dumpSortedSet   = 2
+	dumpHyperLogLog = 3
+)
+
+func dump(value interface{}) []byte {
+	blob := []byte{dumpVersion}
+
+	switch v := value.(type) {
+	case []byte:
+		blob = append(blob, dumpString)
+		blob = append(blob, v...)
+	case *sortedSet:
+		blob = append(blob, dumpSortedSet)
+		blob = binary.AppendUvarint(blob, uint64(len(v.members)))
+		for _, m := range v.members {
+			blob = binary.AppendUvarint(blob, uint64(len(m.Member)))
+			blob = append(blob, m.Member...)
+			blob = binary.LittleEndian.AppendUint64(blob, math.Float64bits(m.Score))
+		}
+	case *hyperLogLog:
+		blob = append(blob, dumpHyperLogLog)
+		blob = append(blob, v.registers[:]...)
+	}
+
+	return binary.LittleEndian.AppendUint32(blob, crc32.ChecksumIEEE(blob))
+}
+
+// DumpedStringLen returns the length of the string held by the dump, ok
+// reporting whether the dump holds a string. The dump isn't checked, Restore
+// still fails if it is corrupt.
+func DumpedStringLen(blob []byte) (n int, ok bool) {
+	if len(blob) < 6 || blob[1] != dumpString {
+		return 0, false
+	}
+
+	return len(blob) - 6, true
+}
+
+// undump turns a dump back into a value, failing with ErrCorruptDump if the
+// dump doesn't pass the checksum or can't be decoded.
+func undump(blob []byte) (interface{}, error) {
+	if len(blob) < 6 {
+		return nil, ErrCorruptDump
+	}
+
+	body, sum := blob[:len(blob)-4], blob[len(blob)-4:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(sum) || body[0] != dumpVersion {
+		return nil, ErrCorruptDump
+	}
+
+	payload := body[2:]
+
+	switch body[1] {
+	case dumpString:
+		return append([]byte(nil), payload...), nil
+	case dumpSortedSet:
+		count, n := binary.Uvarint(payload)
+		if n <= 0 {
+			return nil, ErrCorruptDump
+		}
+		payload = payload[n:]
+
+		z := newSortedSet()
+		for i := uint64(0); i < count; i++ {
+			size, n := binary.Uvarint(payload)
+			// size comes from the dump, size+8 could overflow
+			if n <= 0 || size > uint64(len(payload)-n) || uint64(len(payload)-n)-size < 8 {
+				return nil, ErrCorruptDump
+			}
+			payload = payload[n:]
+
+			member := string(payload[:size])
+			score := math.Float64frombits(binary.LittleEndian.Uint64(payload[size:]))
+			payload = payload[size+8:]
+
+			// zadd rejects NaN, which sorted sets can't order
+			if math.IsNaN(score) {
+				return nil, ErrCorruptDump
+			}
+
+			z.add(score, member)
+		}
+		if len(payload) != 0 {
+			return nil, ErrCorruptDump
+		}
+
+		return z, nil
+	case dumpHyperLogLog:
+		h := &hyperLogLog{}
+		if len(payload) != len(h.registers) {
+			return nil, ErrCorruptDump
+		}
+		copy(h.registers[:], payload)
+
+		return h, nil
+	default:
+		return nil, ErrCorruptDump
+	}
+}
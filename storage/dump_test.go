@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"math"
+	"testing"
+)
+
+// TestRestoreRejectsNaNScores checks that a dump of a sorted set holding a NaN
+// score, which zadd never stores but a crafted dump may hold, is rejected,
+// and that zadd on the key works afterwards.
+func TestRestoreRejectsNaNScores(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	z := newSortedSet()
+	z.members = []ScoredMember{{"a", math.NaN()}, {"b", 1}}
+	z.scores["a"], z.scores["b"] = math.NaN(), 1
+
+	if err := s.Restore("z", 0, dump(z)); err != ErrCorruptDump {
+		t.Fatalf("Restore returned %v, want ErrCorruptDump", err)
+	}
+
+	if _, err := s.ZAdd("z", 1, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if score, ok, err := s.ZScore("z", "a"); err != nil || !ok || score != 1 {
+		t.Fatalf("ZScore returned %v, %v, %v, want 1, true, nil", score, ok, err)
+	}
+}
+
+// TestSortedSetAddUpdatesUnorderedMember checks that updating the score of a
+// member the slice doesn't order, such as one with a NaN score, replaces it
+// rather than corrupting the slice.
+func TestSortedSetAddUpdatesUnorderedMember(t *testing.T) {
+	z := newSortedSet()
+	z.members = []ScoredMember{{"a", math.NaN()}, {"b", 1}}
+	z.scores["a"], z.scores["b"] = math.NaN(), 1
+
+	z.add(2, "a")
+
+	want := []ScoredMember{{"b", 1}, {"a", 2}}
+	if len(z.members) != len(want) || z.members[0] != want[0] || z.members[1] != want[1] {
+		t.Fatalf("members are %v, want %v", z.members, want)
+	}
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+const (
+	// hllPrecision is the number of hash bits selecting a register, 2^14
+	// registers give the standard error of 1.04/sqrt(2^14) ~ 0.81%
+	hllPrecision = 14
+	hllRegisters = 1 << hllPrecision
+)
+
+// hyperLogLog estimates the number of distinct elements added to it.
+type hyperLogLog struct {
+	registers [hllRegisters]uint8
+}
+
+// add adds the element and reports whether the estimation has changed.
+func (h *hyperLogLog) add(element string) bool {
+	x := hllHash(element)
+
+	i := x >> (64 - hllPrecision)
+	// the sentinel bit caps the rank when all remaining bits are zero
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+
+	if rank > h.registers[i] {
+		h.registers[i] = rank
+		return true
+	}
+
+	return false
+}
+
+// merge makes the estimation cover the elements added to other as well.
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	for i, rank := range other.registers {
+		if rank > h.registers[i] {
+			h.registers[i] = rank
+		}
+	}
+}
+
+func (h *hyperLogLog) count() uint64 {
+	const m = float64(hllRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+
+	sum := 0.0
+	zeros := 0
+	for _, rank := range h.registers {
+		sum += 1 / float64(uint64(1)<<rank)
+		if rank == 0 {
+			zeros++
+		}
+	}
+
+	estimate := alpha * m * m / sum
+
+	// small cardinalities are estimated more precisely by linear counting
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+
+	return uint64(estimate + 0.5)
+}
+
+// hllHash hashes the element, mixing the bits of the FNV hash with the
+// MurmurHash3 finalizer as register selection relies on the top bits.
+func hllHash(element string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(element))
+	x := h.Sum64()
+
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+
+	return x
+}
@@ -0,0 +1,547 @@
+package storage
+
+import (
+	"hash/crc32"
+	"time"
+)
+
+const (
+	// Go maps never shrink, so the maps are rebuilt to reclaim the memory
+	// held by deleted keys. Rebuilding costs O(n), so it only happens once
+	// the keys deleted since the last rebuild outnumber the live ones, which
+	// keeps its amortized cost per delete constant.
+	gcMinDeleted = 1024
+
+	// expireSampleSize is the number of keys with an expiration time checked
+	// by every round of active expiration.
+	expireSampleSize = 20
+
+	// evictSampleSize is the number of keys sampled to find the least
+	// recently used one to evict.
+	evictSampleSize = 5
+)
+
+// keyspace holds the values of the storage along with their expiration times
+// and tags. Expired keys are removed lazily when accessed, and actively by
+// expireSample so that keys nobody accesses anymore don't linger.
+type keyspace struct {
+	values  map[string]entry
+	expires map[string]time.Time
+	// tags maps the tags to the keys they are attached to, and tagged maps
+	// the tagged keys to their tag, both kept in sync with the keys
+	tags   map[string]map[string]struct{}
+	tagged map[string]string
+	// checksums makes entries holding strings keep their CRC32, so that
+	// corrupted values can be detected
+	checksums bool
+	// codec encodes the strings as they are stored unless nil, see Codec
+	codec Codec
+	// backend has the keys deleted or expired deleted from it as well, so
+	// that they aren't loaded back, see remove
+	backend Backend
+	// maxKeys bounds the number of keys unless zero, new keys beyond it are
+	// either rejected or make room by evicting keys if evict is set
+	maxKeys int
+	evict   bool
+	// evictions, expirations and deletions count the keys removed by each
+	// reason, see remove
+	evictions   uint64
+	expirations uint64
+	deletions   uint64
+	// deleted counts the keys deleted since the maps were last rebuilt
+	deleted int
+
+	// background makes compact rebuild the maps on a goroutine of its own.
+	// Meanwhile frozen holds the maps being rebuilt, which are only read,
+	// while the keys of frozen touched since are copied to the maps of the
+	// keyspace and listed in touched, see promote. frozenLeft counts the
+	// keys of frozen not touched yet, and rebuilt receives the rebuilt maps.
+	background   bool
+	frozen       *keyMaps
+	touched      map[string]struct{}
+	frozenLeft   int
+	rebuilt      chan *keyMaps
+	rebuildStart time.Time
+
+	compactions    uint64
+	compactionTime time.Duration
+}
+
+// removal is the reason a key is removed for.
+type removal int
+
+const (
+	// removeDeleted removes a key deleted by a command.
+	removeDeleted removal = iota
+	// removeExpired removes a key past its expiration time.
+	removeExpired
+	// removeEvicted removes a key to make room for a new one.
+	removeEvicted
+	// removeMoved removes the source of a rename, which isn't counted as a
+	// removal but is deleted from the backend as it moved.
+	removeMoved
+	// removeReplaced removes the destination a rename overwrites, which
+	// isn't counted as a removal either.
+	removeReplaced
+)
+
+// keyMaps holds the maps of a keyspace which have an element per key.
+type keyMaps struct {
+	values  map[string]entry
+	expires map[string]time.Time
+	tagged  map[string]string
+}
+
+// rebuild copies the maps into maps sized for their current contents, which
+// reclaims the memory held by deleted keys.
+func (m *keyMaps) rebuild() *keyMaps {
+	values := make(map[string]entry, len(m.values))
+	for k, e := range m.values {
+		values[k] = e
+	}
+
+	expires := make(map[string]time.Time, len(m.expires))
+	for k, at := range m.expires {
+		expires[k] = at
+	}
+
+	tagged := make(map[string]string, len(m.tagged))
+	for k, tag := range m.tagged {
+		tagged[k] = tag
+	}
+
+	return &keyMaps{values: values, expires: expires, tagged: tagged}
+}
+
+// entry is a value stored in the keyspace.
+type entry struct {
+	// value is either of type []byte, *sortedSet or *hyperLogLog, strings are
+	// kept as byte slices so that bit operations can update them in place
+	value interface{}
+	// accessed is the last time the value was read or written
+	accessed time.Time
+	// crc is the CRC32 of string values if the keyspace keeps checksums
+	crc uint32
+}
+
+func newKeyspace() *keyspace {
+	return &keyspace{
+		values:  make(map[string]entry),
+		expires: make(map[string]time.Time),
+		tags:    make(map[string]map[string]struct{}),
+		tagged:  make(map[string]string),
+	}
+}
+
+// get returns the value stored under the key, removing the key if it has
+// expired. The key is marked as accessed.
+func (ks *keyspace) get(key string) (interface{}, bool) {
+	e, ok := ks.peek(key)
+	if !ok {
+		return nil, false
+	}
+
+	e.accessed = time.Now()
+	ks.values[key] = e
+
+	return e.value, true
+}
+
+// peek returns the entry stored under the key like get does, without marking
+// the key as accessed.
+func (ks *keyspace) peek(key string) (entry, bool) {
+	ks.promote(key)
+
+	e, ok := ks.values[key]
+	if !ok {
+		return entry{}, false
+	}
+
+	if at, ok := ks.expires[key]; ok && !time.Now().Before(at) {
+		ks.remove(key, removeExpired)
+		return entry{}, false
+	}
+
+	return e, true
+}
+
+// admit makes room for the key if it would exceed the max number of keys,
+// evicting the least recently used key of a sample or failing with
+// ErrMaxKeys depending on the policy. Operations which may create keys admit
+// them first.
+func (ks *keyspace) admit(key string) error {
+	if ks.maxKeys <= 0 || ks.len() < ks.maxKeys {
+		return nil
+	}
+	if _, ok := ks.peek(key); ok {
+		return nil
+	}
+	if !ks.evict {
+		return ErrMaxKeys
+	}
+
+	for ks.len() >= ks.maxKeys {
+		ks.evictSample()
+	}
+
+	return nil
+}
+
+// evictSample removes the least recently used key among a sample of the keys,
+// relying on the random order of map iteration.
+func (ks *keyspace) evictSample() {
+	var victim string
+	var oldest entry
+	sampled := 0
+
+	for key, e := range ks.values {
+		if sampled == 0 || e.accessed.Before(oldest.accessed) {
+			victim, oldest = key, e
+		}
+
+		if sampled++; sampled >= evictSampleSize {
+			break
+		}
+	}
+	if ks.frozen != nil && sampled < evictSampleSize {
+		for key, e := range ks.frozen.values {
+			if _, ok := ks.touched[key]; ok {
+				continue
+			}
+			if sampled == 0 || e.accessed.Before(oldest.accessed) {
+				victim, oldest = key, e
+			}
+
+			if sampled++; sampled >= evictSampleSize {
+				break
+			}
+		}
+	}
+
+	if sampled > 0 {
+		ks.remove(victim, removeEvicted)
+	}
+}
+
+// put stores the value under the key, keeping the expiration time of the key
+// if it has one. Strings are encoded by the codec if any.
+func (ks *keyspace) put(key string, value interface{}) {
+	ks.promote(key)
+
+	e := entry{value: value, accessed: time.Now()}
+	if b, ok := value.([]byte); ok {
+		if ks.checksums {
+			e.crc = crc32.ChecksumIEEE(b)
+		}
+		if ks.codec != nil {
+			e.value = ks.codec.Encode(b)
+		}
+	}
+
+	ks.values[key] = e
+}
+
+// checksum returns the CRC32 of the string b stored under the key, which must
+// exist, and reports whether the string still matches the CRC32 it was stored
+// with. Without checksums kept, the CRC32 is computed and always matches.
+func (ks *keyspace) checksum(key string, b []byte) (crc uint32, valid bool) {
+	ks.promote(key)
+
+	e := ks.values[key]
+
+	crc = crc32.ChecksumIEEE(b)
+	if !ks.checksums {
+		return crc, true
+	}
+
+	return e.crc, crc == e.crc
+}
+
+// set stores the value under the key, discarding the expiration time and the
+// tag of the key if it had them.
+func (ks *keyspace) set(key string, value interface{}) {
+	ks.put(key, value)
+	delete(ks.expires, key)
+	ks.untag(key)
+}
+
+// tag attaches the tag to the key, replacing its previous tag.
+func (ks *keyspace) tag(key, tag string) {
+	ks.promote(key)
+	ks.untag(key)
+
+	keys, ok := ks.tags[tag]
+	if !ok {
+		keys = make(map[string]struct{})
+		ks.tags[tag] = keys
+	}
+	keys[key] = struct{}{}
+	ks.tagged[key] = tag
+}
+
+// untag detaches the key from its tag if it has one.
+func (ks *keyspace) untag(key string) {
+	ks.promote(key)
+
+	tag, ok := ks.tagged[key]
+	if !ok {
+		return
+	}
+
+	delete(ks.tagged, key)
+	if keys := ks.tags[tag]; len(keys) > 1 {
+		delete(keys, key)
+	} else {
+		delete(ks.tags, tag)
+	}
+}
+
+// taggedKeys returns the keys the tag is attached to.
+func (ks *keyspace) taggedKeys(tag string) []string {
+	keys := make([]string, 0, len(ks.tags[tag]))
+	for key := range ks.tags[tag] {
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// del removes the key and returns its value, ok reports whether the key was
+// found. A key not found is deleted from the backend all the same, as it may
+// hold it.
+func (ks *keyspace) del(key string) (interface{}, bool) {
+	value, ok := ks.get(key)
+	if ok {
+		ks.remove(key, removeDeleted)
+	} else if ks.backend != nil {
+		ks.backend.Delete(key)
+	}
+
+	return value, ok
+}
+
+// rename moves the value of the key src to the key dst along with its
+// expiration time and tag. The key src must exist, dst is overwritten.
+func (ks *keyspace) rename(src, dst string) {
+	ks.promote(src)
+
+	e := ks.values[src]
+	at, expires := ks.expires[src]
+	tag, tagged := ks.tagged[src]
+
+	ks.remove(src, removeMoved)
+	if _, ok := ks.peek(dst); ok {
+		ks.remove(dst, removeReplaced)
+	}
+
+	// the entry is moved as is, its string being encoded already
+	e.accessed = time.Now()
+	ks.values[dst] = e
+	if expires {
+		ks.expireAt(dst, at)
+	}
+	if tagged {
+		ks.tag(dst, tag)
+	}
+}
+
+// ttl returns the time left until the key expires, ok reports whether the key
+// has an expiration time.
+func (ks *keyspace) ttl(key string) (time.Duration, bool) {
+	at, ok := ks.expiration(key)
+	if !ok {
+		return 0, false
+	}
+
+	return time.Until(at), true
+}
+
+// expiration returns the time the key expires at, ok reports whether the key
+// has an expiration time.
+func (ks *keyspace) expiration(key string) (at time.Time, ok bool) {
+	ks.promote(key)
+
+	at, ok = ks.expires[key]
+
+	return at, ok
+}
+
+// expireAt makes the key expire at the given time.
+func (ks *keyspace) expireAt(key string, at time.Time) {
+	ks.promote(key)
+	ks.expires[key] = at
+}
+
+// remove removes the key, counting its removal by the reason. Every key
+// removed goes through remove, so that the counts add up. Keys deleted,
+// expired or moved are deleted from the backend too, while evicted keys are
+// kept there to be loaded back.
+func (ks *keyspace) remove(key string, reason removal) {
+	ks.promote(key)
+
+	delete(ks.values, key)
+	delete(ks.expires, key)
+	ks.untag(key)
+	ks.deleted++
+
+	switch reason {
+	case removeDeleted:
+		ks.deletions++
+	case removeExpired:
+		ks.expirations++
+	case removeEvicted:
+		ks.evictions++
+	}
+
+	if ks.backend != nil && (reason == removeDeleted || reason == removeExpired || reason == removeMoved) {
+		ks.backend.Delete(key)
+	}
+}
+
+// expireSample removes the expired keys among a sample of the keys with an
+// expiration time, relying on the random order of map iteration.
+func (ks *keyspace) expireSample() {
+	now := time.Now()
+	checked := 0
+
+	for key, at := range ks.expires {
+		if !now.Before(at) {
+			ks.remove(key, removeExpired)
+		}
+
+		if checked++; checked >= expireSampleSize {
+			break
+		}
+	}
+	if ks.frozen != nil && checked < expireSampleSize {
+		for key, at := range ks.frozen.expires {
+			if _, ok := ks.touched[key]; !ok && !now.Before(at) {
+				ks.remove(key, removeExpired)
+			}
+
+			if checked++; checked >= expireSampleSize {
+				break
+			}
+		}
+	}
+}
+
+// len returns the number of keys, including expired keys not removed yet.
+func (ks *keyspace) len() int {
+	return len(ks.values) + ks.frozenLeft
+}
+
+// keys returns every key, including expired keys not removed yet.
+func (ks *keyspace) keys() []string {
+	keys := make([]string, 0, ks.len())
+	for key := range ks.values {
+		keys = append(keys, key)
+	}
+	if ks.frozen != nil {
+		for key := range ks.frozen.values {
+			if _, ok := ks.touched[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys
+}
+
+// promote copies the key from the maps being rebuilt in the background to
+// the maps of the keyspace the first time it is touched, so that every
+// operation finds it there and leaves the maps being rebuilt untouched. It
+// must be called before accessing the key in the maps.
+func (ks *keyspace) promote(key string) {
+	if ks.frozen == nil {
+		return
+	}
+
+	e, ok := ks.frozen.values[key]
+	if !ok {
+		return
+	}
+	if _, ok := ks.touched[key]; ok {
+		return
+	}
+
+	ks.touched[key] = struct{}{}
+	ks.frozenLeft--
+
+	ks.values[key] = e
+	if at, ok := ks.frozen.expires[key]; ok {
+		ks.expires[key] = at
+	}
+	if tag, ok := ks.frozen.tagged[key]; ok {
+		ks.tagged[key] = tag
+	}
+}
+
+// compact rebuilds the maps if enough keys have been deleted since they were
+// last rebuilt.
+func (ks *keyspace) compact() {
+	if ks.frozen != nil || ks.deleted < gcMinDeleted || ks.deleted < ks.len() {
+		return
+	}
+
+	maps := &keyMaps{values: ks.values, expires: ks.expires, tagged: ks.tagged}
+	ks.deleted = 0
+
+	if ks.background {
+		ks.compactInBackground(maps)
+		return
+	}
+
+	start := time.Now()
+
+	maps = maps.rebuild()
+	ks.values, ks.expires, ks.tagged = maps.values, maps.expires, maps.tagged
+
+	ks.compactions++
+	ks.compactionTime += time.Since(start)
+}
+
+// compactInBackground freezes the maps and rebuilds them on a goroutine of
+// its own, sending the rebuilt maps to rebuilt once done. Meanwhile the
+// keyspace serves the keys from the frozen maps and keeps the keys touched in
+// fresh maps, see promote.
+func (ks *keyspace) compactInBackground(maps *keyMaps) {
+	ks.frozen = maps
+	ks.frozenLeft = len(maps.values)
+	ks.touched = make(map[string]struct{})
+	ks.values = make(map[string]entry)
+	ks.expires = make(map[string]time.Time)
+	ks.tagged = make(map[string]string)
+
+	ks.rebuildStart = time.Now()
+	ks.rebuilt = make(chan *keyMaps, 1)
+
+	go func(rebuilt chan<- *keyMaps) {
+		rebuilt <- maps.rebuild()
+	}(ks.rebuilt)
+}
+
+// finishCompaction swaps in the maps rebuilt in the background, once the keys
+// touched since the rebuild started are replayed onto them.
+func (ks *keyspace) finishCompaction(maps *keyMaps) {
+	for key := range ks.touched {
+		delete(maps.values, key)
+		delete(maps.expires, key)
+		delete(maps.tagged, key)
+	}
+	for k, e := range ks.values {
+		maps.values[k] = e
+	}
+	for k, at := range ks.expires {
+		maps.expires[k] = at
+	}
+	for k, tag := range ks.tagged {
+		maps.tagged[k] = tag
+	}
+
+	ks.values, ks.expires, ks.tagged = maps.values, maps.expires, maps.tagged
+	ks.frozen, ks.frozenLeft, ks.touched, ks.rebuilt = nil, 0, nil, nil
+
+	ks.compactions++
+	ks.compactionTime += time.Since(ks.rebuildStart)
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestBackgroundCompactionKeepsWrites checks that no write is lost while the
+// maps are rebuilt in the background: writers keep setting, tagging and
+// deleting keys, deleting enough of them to trigger compactions, then every
+// key is checked. Run it with -race, the rebuild running on a goroutine of its
+// own.
+func TestBackgroundCompactionKeepsWrites(t *testing.T) {
+	s := NewWithOptions(Options{BackgroundCompaction: true})
+	defer s.Close()
+
+	const (
+		writers = 4
+		keys    = 2000
+		rounds  = 5
+	)
+
+	// every writer owns its keys and tag, and tracks what they should hold
+	want := make([]map[string]string, writers)
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		want[w] = make(map[string]string)
+
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			tag := fmt.Sprintf("tag%d", w)
+			for round := 0; round < rounds; round++ {
+				for i := 0; i < keys; i++ {
+					key := fmt.Sprintf("w%d:k%d", w, i)
+					value := fmt.Sprintf("%d-%d-%d", w, i, round)
+					if err := s.SetTagged(key, value, tag); err != nil {
+						t.Errorf("SetTagged(%s) failed: %v", key, err)
+						return
+					}
+					want[w][key] = value
+				}
+
+				// most keys are deleted, keeping a different tenth of them
+				// every round
+				for i := 0; i < keys; i++ {
+					if i%10 == round {
+						continue
+					}
+					key := fmt.Sprintf("w%d:k%d", w, i)
+					if !s.Del(key) {
+						t.Errorf("Del(%s) didn't find the key", key)
+						return
+					}
+					delete(want[w], key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if s.Stats().Compactions == 0 {
+		t.Fatal("no compaction was triggered")
+	}
+
+	for w := 0; w < writers; w++ {
+		for i := 0; i < keys; i++ {
+			key := fmt.Sprintf("w%d:k%d", w, i)
+			value, ok, err := s.Get(key)
+			if err != nil {
+				t.Fatalf("Get(%s) failed: %v", key, err)
+			}
+			if wantValue, wantOK := want[w][key]; ok != wantOK || value != wantValue {
+				t.Errorf("Get(%s) = %q, %v, want %q, %v", key, value, ok, wantValue, wantOK)
+			}
+		}
+
+		if count, wantCount := s.CountTag(fmt.Sprintf("tag%d", w)), len(want[w]); count != wantCount {
+			t.Errorf("tag%d is attached to %d keys, want %d", w, count, wantCount)
+		}
+	}
+}
+
+// BenchmarkDeleteHeavy measures the latency of a workload replacing its keys
+// with new ones, whose deletes trigger a compaction every so often, with the
+// maps rebuilt inline or in the background. Besides the mean, it reports the
+// latency percentiles of the operations, which the compactions inflate.
+func BenchmarkDeleteHeavy(b *testing.B) {
+	for _, background := range []bool{false, true} {
+		name := "inline"
+		if background {
+			name = "background"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			s := NewWithOptions(Options{BackgroundCompaction: background})
+			defer s.Close()
+
+			const live = 100000
+			for i := 0; i < live; i++ {
+				s.Set(fmt.Sprintf("k%d", i), "v")
+			}
+
+			latencies := make([]time.Duration, b.N)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				s.Set(fmt.Sprintf("k%d", live+i), "v")
+				s.Del(fmt.Sprintf("k%d", i))
+				latencies[i] = time.Since(start)
+			}
+
+			b.StopTimer()
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(latencies[b.N/2].Nanoseconds()), "p50-ns")
+			b.ReportMetric(float64(latencies[b.N*99/100].Nanoseconds()), "p99-ns")
+			b.ReportMetric(float64(latencies[b.N*999/1000].Nanoseconds()), "p99.9-ns")
+			b.ReportMetric(float64(latencies[b.N-1].Nanoseconds()), "max-ns")
+		})
+	}
+}
+
+// BenchmarkCompactionTrigger compares the trigger rebuilding the maps every
+// gcMinDeleted deletes, which storage used to have, with the one waiting for
+// the deleted keys to outnumber the live ones, on a delete-heavy workload.
+// The periodic trigger copies the live keys every gcMinDeleted deletes, so
+// its rebuilds are as long as the ratio trigger's but far more frequent,
+// which shows in the compactions and the time per operation.
+func BenchmarkCompactionTrigger(b *testing.B) {
+	triggers := map[string]func(ks *keyspace){
+		"period": func(ks *keyspace) {
+			if ks.deleted < gcMinDeleted {
+				return
+			}
+
+			maps := (&keyMaps{values: ks.values, expires: ks.expires, tagged: ks.tagged}).rebuild()
+			ks.values, ks.expires, ks.tagged = maps.values, maps.expires, maps.tagged
+			ks.deleted = 0
+			ks.compactions++
+		},
+		"ratio": (*keyspace).compact,
+	}
+
+	for _, name := range []string{"period", "ratio"} {
+		compact := triggers[name]
+
+		b.Run(name, func(b *testing.B) {
+			ks := newKeyspace()
+
+			const live = 100000
+			for i := 0; i < live; i++ {
+				ks.set(fmt.Sprintf("k%d", i), []byte("v"))
+			}
+
+			latencies := make([]time.Duration, b.N)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				ks.set(fmt.Sprintf("k%d", live+i), []byte("v"))
+				ks.del(fmt.Sprintf("k%d", i))
+				compact(ks)
+				latencies[i] = time.Since(start)
+			}
+
+			b.StopTimer()
+
+			sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+			b.ReportMetric(float64(ks.compactions)/float64(b.N), "compactions/op")
+			b.ReportMetric(float64(latencies[b.N/2].Nanoseconds()), "p50-ns")
+			b.ReportMetric(float64(latencies[b.N*99/100].Nanoseconds()), "p99-ns")
+			b.ReportMetric(float64(latencies[b.N*999/1000].Nanoseconds()), "p99.9-ns")
+			b.ReportMetric(float64(latencies[b.N-1].Nanoseconds()), "max-ns")
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package storage
+
+import "unsafe"
+
+const (
+	// entryOverhead approximates the memory taken by a map entry besides the
+	// key and value contents: the string header of the key, the interface
+	// holding the value and the bookkeeping of map buckets.
+	entryOverhead = 64
+	// memberOverhead approximates the memory taken by a sorted set member
+	// besides its contents: its entry in the scores map and in the ordered
+	// slice.
+	memberOverhead = 2*int(unsafe.Sizeof(ScoredMember{})) + 16
+)
+
+// memoryUsage estimates the number of bytes taken by the key and its value.
+func memoryUsage(key string, value interface{}) int {
+	usage := entryOverhead + len(key)
+
+	switch v := value.(type) {
+	case []byte:
+		usage += cap(v)
+	case *sortedSet:
+		for _, m := range v.members {
+			usage += memberOverhead + len(m.Member)
+		}
+	case *hyperLogLog:
+		usage += int(unsafe.Sizeof(*v))
+	}
+
+	return usage
+}
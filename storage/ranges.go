@@ -0,0 +1,43 @@
+package storage
+
+// Index ranges.
+//
+// Operations taking a range of indexes, such as ZRange, BitCount and
+// GetRange, select the elements between start and end, both inclusive.
+// Negative indexes count from the end of the sequence, -1 being its last
+// element and -n its first one for a sequence of n elements. Once converted,
+// indexes out of the sequence are clamped to its bounds, and a range whose
+// start is past its end selects nothing. For a sequence of 3 elements:
+//
+//	0 2    selects all of them
+//	0 -1   selects all of them
+//	-5 10  selects all of them
+//	1 1    selects the second one
+//	2 1    selects nothing
+//	5 10   selects nothing
+//
+// Every range operation goes through normalizeRange, so that they all agree
+// on these semantics.
+
+// normalizeRange converts the inclusive range between start and end of a
+// sequence of n elements to the half-open range [from, to) of the indexes it
+// selects, from equals to if it selects nothing.
+func normalizeRange(start, end, n int) (from, to int) {
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+	if start > end {
+		return 0, 0
+	}
+
+	return start, end + 1
+}
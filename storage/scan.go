@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"container/heap"
+	"strings"
+	"time"
+)
+
+// KeyValue is a key along with the string stored under it.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// scan returns the keys holding strings which start with the prefix and sort
+// after the key after, the first count of them in key order. Expired keys
+// not removed yet are skipped. Selecting them costs O(n log count) for n
+// keys, without allocating more than count keys. A count below 1 selects no
+// keys.
+func (ks *keyspace) scan(prefix, after string, count int) []string {
+	if count <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	selected := &keyHeap{}
+
+	consider := func(key string, e entry, at time.Time, expires bool) {
+		if key <= after || !strings.HasPrefix(key, prefix) {
+			return
+		}
+		if _, ok := e.value.([]byte); !ok {
+			return
+		}
+		if expires && !now.Before(at) {
+			return
+		}
+		if selected.Len() == count {
+			if key > (*selected)[0] {
+				return
+			}
+			heap.Pop(selected)
+		}
+		heap.Push(selected, key)
+	}
+
+	for key, e := range ks.values {
+		at, expires := ks.expires[key]
+		consider(key, e, at, expires)
+	}
+	if ks.frozen != nil {
+		for key, e := range ks.frozen.values {
+			if _, ok := ks.touched[key]; ok {
+				continue
+			}
+			at, expires := ks.frozen.expires[key]
+			consider(key, e, at, expires)
+		}
+	}
+
+	keys := make([]string, selected.Len())
+	for i := len(keys) - 1; i >= 0; i-- {
+		keys[i] = heap.Pop(selected).(string)
+	}
+
+	return keys
+}
+
+// keyHeap is a max-heap of keys, whose root is the greatest key selected so
+// far by scan.
+type keyHeap []string
+
+func (h keyHeap) Len() int           { return len(h) }
+func (h keyHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h keyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *keyHeap) Push(x interface{}) {
+	*h = append(*h, x.(string))
+}
+
+func (h *keyHeap) Pop() interface{} {
+	old := *h
+	key := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return key
+}
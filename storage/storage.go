@@ -0,0 +1,1846 @@
+// Package storage implements the in-memory key-value storage behind the carrot
+// server. It can be embedded into other programs to be used in-process.
+//
+// All operations on a Store are served by a single goroutine that owns the
+// data, so a Store is safe for concurrent use and every operation observes
+// the effects of all operations completed before it.
+//
+// The storage is not sharded: operations involving several keys, such as
+// PFCount and PFMerge, are applied in a single step of that goroutine and are
+// therefore atomic, no other operation observes them half done.
+//
+// In particular a write is applied before its method returns, so a read
+// following it, from the same goroutine or from any goroutine that learned
+// about the write, observes it. The server relies on this to guarantee that
+// pipelined commands observe the writes of the commands sent before them.
+// Changes such as sharding the storage or adding asynchronous write paths must
+// preserve it.
+//
+// Values cross the Store boundary as copies: the strings passed to writes are
+// copied into the Store, and the values returned by reads are the caller's
+// own, which later writes never change. GetUnsafe is the one exception, for
+// callers which can't afford the copy, see its documentation.
+package storage
+
+import (
+	"errors"
+	"hash/crc32"
+	"math"
+	"path"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrWrongType is returned when an operation is applied to a key holding
+	// a value of another type.
+	ErrWrongType = errors.New("operation against a key holding the wrong kind of value")
+	// ErrNotInteger is returned when an operation expecting an integer finds
+	// something else.
+	ErrNotInteger = errors.New("value is not an integer")
+	// ErrOverflow is returned when an integer operation would overflow.
+	ErrOverflow = errors.New("increment or decrement would overflow")
+	// ErrKeyExists is returned when an operation creating a key finds it
+	// already exists.
+	ErrKeyExists = errors.New("key already exists")
+	// ErrCorruptValue is returned when reading a string which the Codec of
+	// the Store fails to decode.
+	ErrCorruptValue = errors.New("value can't be decoded by the codec, it is corrupt")
+	// ErrChecksumMismatch is returned when reading a string which doesn't
+	// match the checksum it was stored with anymore.
+	ErrChecksumMismatch = errors.New("value doesn't match its checksum, it is corrupt")
+	// ErrCorruptDump is returned when restoring a dump which is corrupt or has
+	// an unsupported format version.
+	ErrCorruptDump = errors.New("dump is corrupt or has an unsupported format version")
+	// ErrMaxKeys is returned when an operation would create a key in a Store
+	// holding its max number of keys and rejecting new ones.
+	ErrMaxKeys = errors.New("max keys reached")
+)
+
+// Sentinel ttls returned by TTLs.
+const (
+	NoTTL      time.Duration = -1
+	MissingTTL time.Duration = -2
+)
+
+// Store is a key-value storage. Values are either strings, sorted sets or
+// HyperLogLogs. Operations creating keys fail with ErrMaxKeys if the Store
+// holds its max number of keys and rejects new ones.
+type Store interface {
+	// Get returns the string stored under the key, ok reports whether the key
+	// was found. A key missing from a Store with a Backend is loaded from it.
+	// A Store keeping checksums fails with ErrChecksumMismatch if the string
+	// doesn't match its checksum. The string is a copy owned by the caller.
+	Get(key string) (value string, ok bool, err error)
+	// GetUnsafe returns the string stored under the key like Get does, but as
+	// a view of the bytes held by the Store rather than a copy. The caller
+	// must not modify the bytes, which would corrupt the Store. The bytes are
+	// left alone by writes replacing the value as a whole, but SetBit updates
+	// them in place, so reading them concurrently with a SetBit on the key is
+	// a data race. Use Get unless the copy matters.
+	GetUnsafe(key string) (value []byte, ok bool, err error)
+	// GetChecksum returns the string stored under the key like Get does,
+	// along with its CRC32, which is the one it was stored with if the Store
+	// keeps checksums.
+	GetChecksum(key string) (value string, crc uint32, ok bool, err error)
+	// GetWithTTL returns the string stored under the key like Get does,
+	// along with the time left until the key expires, read in the same step.
+	// The ttl is negative if the key has no expiration time.
+	GetWithTTL(key string) (value string, ttl time.Duration, ok bool, err error)
+	// TTLs returns the time left until each of the keys expires, all read in
+	// a single step. The ttl is NoTTL for a key without an expiration time,
+	// and MissingTTL for a missing key.
+	TTLs(keys []string) []time.Duration
+	// Scan returns the keys holding strings which start with the prefix and
+	// sort after the key after, at most count of them in key order along with
+	// their strings, all read in a single step. more reports whether keys are
+	// left, which the next Scan returns if passed the last key as after. Keys
+	// present throughout a series of Scans are returned once, keys created
+	// or removed meanwhile may be missed. Keys holding other types are
+	// skipped, as are keys of the Backend not loaded yet. A count below 1
+	// returns no keys. Every Scan walks all the keys, so going through n keys
+	// count at a time costs O(n²/count): count should be large enough for
+	// the number of keys.
+	Scan(prefix, after string, count int) (pairs []KeyValue, more bool)
+	// GetDefault returns the string stored under the key like Get does, or
+	// the default value if the key is missing, found reporting which. The
+	// key is never created.
+	GetDefault(key, def string) (value string, found bool, err error)
+	// Set stores the string under the key, replacing any previous value
+	// regardless of its type, and writes it through to the Backend if any.
+	// The key loses its expiration time, if it had one, and never expires
+	// unless set to again.
+	Set(key, value string) error
+	// GetSetEx stores the string under the key, set to expire after the ttl,
+	// and returns the string previously stored there, ok reporting whether
+	// there was one. It fails with ErrWrongType, leaving the key untouched, if
+	// the key holds another type.
+	GetSetEx(key, value string, ttl time.Duration) (old string, ok bool, err error)
+	// SetChanged stores the string under the key like Set does, or like
+	// SetTagged does if the tag isn't empty, and reports whether the string
+	// differs from the value previously stored there. A missing key or a
+	// value of another type differs from any string.
+	SetChanged(key, value, tag string) (changed bool, err error)
+	// SetKeepTTL stores the string under the key like SetChanged does, but
+	// keeps the expiration time of the key if it had one.
+	SetKeepTTL(key, value, tag string) (changed bool, err error)
+	// Del removes the key and reports whether it was found.
+	Del(key string) (removed bool)
+	// Unlink removes the key like Del does, but frees the removed value on a
+	// background goroutine.
+	Unlink(key string) (removed bool)
+	// RenameNX renames the key src to dst unless dst exists, and reports
+	// whether it did. The expiration time and tag of the key are kept, ok
+	// reports whether src was found. Both keys are looked up in the Backend
+	// too, src moving from its key to dst there as well.
+	RenameNX(src, dst string) (renamed, ok bool)
+	// SetTagged stores the string under the key like Set does, and attaches
+	// the tag to the key. A key has at most one tag, which is detached when
+	// the key is removed or its value is replaced as a whole.
+	SetTagged(key, value, tag string) error
+	// DelTag removes the keys the tag is attached to and returns their
+	// number.
+	DelTag(tag string) int
+	// DelPattern removes the keys matching the pattern and returns their
+	// number. Patterns have the syntax of path.Match, so * doesn't match a
+	// slash, and a malformed pattern fails with path.ErrBadPattern. The whole
+	// keyspace is scanned, blocking every other operation meanwhile.
+	DelPattern(pattern string) (int, error)
+	// CountPattern returns the number of keys matching the pattern, which
+	// DelPattern would remove. It scans the whole keyspace like DelPattern.
+	CountPattern(pattern string) (int, error)
+	// CountTag returns the number of keys the tag is attached to.
+	CountTag(tag string) int
+	// ExpireTag makes the keys the tag is attached to expire after the ttl
+	// and returns their number.
+	ExpireTag(tag string, ttl time.Duration) int
+	// ZAdd adds the member with the score to the sorted set stored under the
+	// key, creating the set if needed. The score of an existing member is
+	// updated. It reports whether the set changed, that is whether the member
+	// is new or had another score.
+	ZAdd(key string, score float64, member string) (changed bool, err error)
+	// ZScore returns the score of the member in the sorted set stored under
+	// the key, ok reports whether the member was found.
+	ZScore(key, member string) (score float64, ok bool, err error)
+	// ZRange returns the members of the sorted set stored under the key
+	// between start and stop inclusive, in ascending score order. Negative
+	// indexes count from the end of the set, -1 being the last member, see
+	// normalizeRange for the details of ranges.
+	ZRange(key string, start, stop int) ([]ScoredMember, error)
+	// ZRangeByScore returns the members of the sorted set stored under the key
+	// with scores between min and max, in ascending score order. The first
+	// offset members are skipped, and at most count members are returned
+	// unless count is negative.
+	ZRangeByScore(key string, min, max ScoreBound, offset, count int) ([]ScoredMember, error)
+	// SetBit sets the bit at the offset of the string stored under the key,
+	// treating it as a bit array grown with zero bytes as needed, and returns
+	// the previous bit. Bits are numbered from the most significant bit of
+	// the first byte.
+	SetBit(key string, offset uint64, bit bool) (old bool, err error)
+	// GetBit returns the bit at the offset of the string stored under the
+	// key, bits beyond the end of the string are zero.
+	GetBit(key string, offset uint64) (bool, error)
+	// BitCount returns the number of set bits in the bytes of the string
+	// stored under the key between start and end inclusive. Negative indexes
+	// count from the end of the string, -1 being the last byte.
+	BitCount(key string, start, end int) (int, error)
+	// GetRange returns the bytes of the string stored under the key between
+	// start and end inclusive, ok reporting whether the key was found.
+	// Negative indexes count from the end of the string, -1 being the last
+	// byte.
+	GetRange(key string, start, end int) (value string, ok bool, err error)
+	// PFAdd adds the elements to the HyperLogLog stored under the key,
+	// creating it if needed, and reports whether its estimation has changed.
+	PFAdd(key string, elements []string) (changed bool, err error)
+	// PFCount returns the approximate number of distinct elements added to
+	// the HyperLogLogs stored under the keys, missing keys count as empty.
+	PFCount(keys []string) (uint64, error)
+	// PFMerge merges the HyperLogLogs stored under the source keys into the
+	// one stored under the destination key, creating it if needed.
+	PFMerge(dest string, sources []string) error
+	// MemoryUsage estimates the number of bytes taken by the key and its
+	// value, ok reports whether the key was found.
+	MemoryUsage(key string) (bytes int, ok bool)
+	// SetIf stores the string under the key if the condition holds for the
+	// string currently stored there, and reports whether it did. A missing key
+	// fails any condition. The expiration time of the key is kept.
+	SetIf(key string, cond Condition, operand, value string) (applied bool, err error)
+	// SetNE stores the string under the key unless the very same string is
+	// already stored there, and reports whether it did. A missing key or a
+	// value of another type differs from any string.
+	SetNE(key, value string) (changed bool, err error)
+	// IncrWithTTL increments the integer stored under the key and returns
+	// the incremented value. A missing key is created with the value 1 and
+	// set to expire after the ttl, the expiration time of an existing key is
+	// left untouched.
+	IncrWithTTL(key string, ttl time.Duration) (int64, error)
+	// IncrCap increments the integer stored under the key unless it has
+	// reached max, and returns the resulting value. capped reports whether the
+	// value was left untouched, a value already above max being kept rather
+	// than lowered. A missing key counts as zero, the expiration time of an
+	// existing key is left untouched.
+	IncrCap(key string, max int64) (value int64, capped bool, err error)
+	// Dump serializes the value stored under the key along with its type, ok
+	// reports whether the key was found. Dumps are versioned and checksummed,
+	// and are turned back into values by Restore.
+	Dump(key string) (blob []byte, ok bool)
+	// Restore stores the value serialized by Dump under the key, expiring it
+	// after the ttl unless the ttl is zero. It fails with ErrKeyExists if the
+	// key exists, and with ErrCorruptDump if the dump fails its checksum.
+	Restore(key string, ttl time.Duration, blob []byte) error
+	// Object describes the value stored under the key, ok reports whether
+	// the key was found. Describing a value doesn't count as accessing it.
+	Object(key string) (info ObjectInfo, ok bool)
+	// Stats returns statistics of the Store.
+	Stats() Stats
+	// Close stops the goroutine serving the Store. The Store must not be used
+	// after Close.
+	Close()
+}
+
+// ObjectInfo describes a value stored in a Store.
+type ObjectInfo struct {
+	// Type is the type of the value: string, zset or hyperloglog.
+	Type string
+	// Encoding is the internal representation of the value: int or raw for
+	// strings depending on whether they hold an integer, sortedslice for
+	// sorted sets and dense for HyperLogLogs.
+	Encoding string
+	// Idle is the time since the value was last read or written.
+	Idle time.Duration
+	// TTL is the time left until the key expires, if HasTTL is set.
+	TTL    time.Duration
+	HasTTL bool
+	// Memory estimates the number of bytes taken by the key and its value.
+	Memory int
+}
+
+// Stats are statistics of a Store.
+type Stats struct {
+	// Keys is the number of keys, including expired keys not removed yet.
+	Keys int
+	// Compactions is the number of times the storage has been rebuilt to
+	// reclaim the memory held by deleted keys.
+	Compactions uint64
+	// CompactionTime is the total time spent on compactions.
+	CompactionTime time.Duration
+	// Evictions is the number of keys evicted to make room for new keys.
+	Evictions uint64
+	// Expirations is the number of keys removed past their expiration time,
+	// whether on access or by active expiration.
+	Expirations uint64
+	// Deletions is the number of keys removed by Del, Unlink, DelTag and
+	// DelPattern.
+	Deletions uint64
+}
+
+// Requests are sent to the goroutine serving the store, which replies on their
+// response channel if they have one. Response channels are buffered, so that
+// replying never blocks the goroutine on a requester slow to receive.
+type (
+	reqSet struct {
+		key   string
+		value string
+		// tag is attached to the key unless empty
+		tag string
+		// keepTTL keeps the expiration time of the key
+		keepTTL bool
+		// compare makes the response report whether the value changed, which
+		// takes reading the value previously stored
+		compare  bool
+		response chan reqSetVal
+	}
+	reqSetVal struct {
+		changed bool
+		err     error
+	}
+	reqRenameNX struct {
+		src      string
+		dst      string
+		response chan reqRenameNXVal
+	}
+	reqRenameNXVal struct {
+		renamed bool
+		ok      bool
+	}
+	reqDelTag struct {
+		tag      string
+		response chan int
+	}
+	reqDelPattern struct {
+		pattern  string
+		response chan reqDelPatternVal
+	}
+	reqDelPatternVal struct {
+		removed int
+		err     error
+	}
+	reqCountPattern struct {
+		pattern  string
+		response chan reqCountPatternVal
+	}
+	reqCountPatternVal struct {
+		count int
+		err   error
+	}
+	reqCountTag struct {
+		tag      string
+		response chan int
+	}
+	reqExpireTag struct {
+		tag      string
+		ttl      time.Duration
+		response chan int
+	}
+	reqGet struct {
+		key string
+		// checksum requests the CRC32 of the string
+		checksum bool
+		// view requests the bytes held by the storage rather than a copy
+		view bool
+		// def is returned for a missing key if hasDefault is set
+		def        string
+		hasDefault bool
+		response   chan reqGetVal
+	}
+	reqGetVal struct {
+		value string
+		// bytes holds the value instead if a view was requested
+		bytes []byte
+		crc   uint32
+		// ttl is negative if the key has no expiration time
+		ttl time.Duration
+		ok  bool
+		err error
+	}
+	reqGetSetEx struct {
+		key      string
+		value    string
+		ttl      time.Duration
+		response chan reqGetVal
+	}
+	reqDel struct {
+		key      string
+		response chan bool
+	}
+	reqUnlink struct {
+		key      string
+		response chan bool
+	}
+	reqZAdd struct {
+		key      string
+		score    float64
+		member   string
+		response chan reqZAddVal
+	}
+	reqZAddVal struct {
+		changed bool
+		err     error
+	}
+	reqZScore struct {
+		key      string
+		member   string
+		response chan reqZScoreVal
+	}
+	reqZScoreVal struct {
+		score float64
+		ok    bool
+		err   error
+	}
+	reqZRange struct {
+		key      string
+		start    int
+		stop     int
+		response chan reqZRangeVal
+	}
+	reqZRangeByScore struct {
+		key      string
+		min      ScoreBound
+		max      ScoreBound
+		offset   int
+		count    int
+		response chan reqZRangeVal
+	}
+	reqZRangeVal struct {
+		members []ScoredMember
+		err     error
+	}
+	reqSetBit struct {
+		key      string
+		offset   uint64
+		bit      bool
+		response chan reqBitVal
+	}
+	reqGetBit struct {
+		key      string
+		offset   uint64
+		response chan reqBitVal
+	}
+	reqBitVal struct {
+		bit bool
+		err error
+	}
+	reqBitCount struct {
+		key      string
+		start    int
+		end      int
+		response chan reqBitCountVal
+	}
+	reqBitCountVal struct {
+		count int
+		err   error
+	}
+	reqGetRange struct {
+		key      string
+		start    int
+		end      int
+		response chan reqGetVal
+	}
+	reqPFAdd struct {
+		key      string
+		elements []string
+		response chan reqPFAddVal
+	}
+	reqPFAddVal struct {
+		changed bool
+		err     error
+	}
+	reqTTLs struct {
+		keys     []string
+		response chan []time.Duration
+	}
+	reqScan struct {
+		prefix   string
+		after    string
+		count    int
+		response chan reqScanVal
+	}
+	reqScanVal struct {
+		pairs []KeyValue
+		more  bool
+	}
+	reqPFCount struct {
+		keys     []string
+		response chan reqPFCountVal
+	}
+	reqPFCountVal struct {
+		count uint64
+		err   error
+	}
+	reqMemoryUsage struct {
+		key      string
+		response chan reqMemoryUsageVal
+	}
+	reqMemoryUsageVal struct {
+		bytes int
+		ok    bool
+	}
+	reqSetIf struct {
+		key      string
+		cond     Condition
+		operand  string
+		value    string
+		response chan reqSetIfVal
+	}
+	reqSetIfVal struct {
+		applied bool
+		err     error
+	}
+	reqSetNE struct {
+		key      string
+		value    string
+		response chan reqSetVal
+	}
+	reqIncrWithTTL struct {
+		key      string
+		ttl      time.Duration
+		response chan reqIncrVal
+	}
+	reqIncrVal struct {
+		value  int64
+		capped bool
+		err    error
+	}
+	reqIncrCap struct {
+		key      string
+		max      int64
+		response chan reqIncrVal
+	}
+	reqDump struct {
+		key      string
+		response chan reqDumpVal
+	}
+	reqDumpVal struct {
+		blob []byte
+		ok   bool
+	}
+	reqRestore struct {
+		key      string
+		ttl      time.Duration
+		value    interface{}
+		response chan error
+	}
+	reqObject struct {
+		key      string
+		response chan reqObjectVal
+	}
+	reqObjectVal struct {
+		info ObjectInfo
+		ok   bool
+	}
+	reqStats struct {
+		response chan Stats
+	}
+	reqPFMerge struct {
+		dest     string
+		sources  []string
+		response chan error
+	}
+)
+
+// Backend is an external store the Store acts as a cache of. Get loads keys
+// missing from the Store from the Backend, and Set as well as the other
+// operations storing whole strings write them through to it. Keys deleted,
+// whether by Del, Unlink, DelTag or DelPattern, and keys expired are deleted
+// from it, so that they aren't loaded back. Keys evicted to make room are
+// kept by it. Backend methods
+// are called by the goroutine serving the Store, so the Store waits for them
+// to return. Reads are served from the Store whenever it holds the key, so a
+// Backend lagging behind its writes never makes a read miss an earlier write.
+type Backend interface {
+	// Load returns the value of the key, ok reports whether the key was found.
+	Load(key string) (value string, ok bool)
+	// Store persists the value of the key.
+	Store(key, value string)
+	// Delete deletes the key, which may be missing.
+	Delete(key string)
+}
+
+// Options configure a Store.
+type Options struct {
+	// Backend is the Backend the Store caches, nil for a standalone Store.
+	Backend Backend
+	// Checksums makes the Store keep the CRC32 of every string and verify it
+	// when the string is read by Get, so that a value corrupted in memory is
+	// reported rather than returned.
+	Checksums bool
+	// MaxKeys bounds the number of keys the Store holds, zero meaning no
+	// bound. What happens to keys created beyond it depends on MaxKeysPolicy.
+	MaxKeys       int
+	MaxKeysPolicy MaxKeysPolicy
+	// BackgroundCompaction makes the Store rebuild its maps to reclaim the
+	// memory held by deleted keys on a goroutine of its own, rather than
+	// blocking every operation for the duration of the rebuild. Keys touched
+	// during the rebuild are copied aside and replayed onto the rebuilt maps,
+	// at the cost of memory and of a little overhead per operation meanwhile.
+	BackgroundCompaction bool
+	// Codec transforms the strings as they are stored and read back, nil
+	// storing them as is. See Codec.
+	Codec Codec
+}
+
+// MaxKeysPolicy decides what happens when a key is created in a Store holding
+// its max number of keys.
+type MaxKeysPolicy int
+
+const (
+	// RejectNewKeys fails the operations creating keys with ErrMaxKeys.
+	RejectNewKeys MaxKeysPolicy = iota
+	// EvictLRU makes room for new keys by evicting the least recently used
+	// key among a few sampled ones, which approximates evicting the least
+	// recently used key of the whole Store.
+	EvictLRU
+)
+
+type store struct {
+	backend       Backend
+	checksums     bool
+	maxKeys       int
+	maxKeysPolicy MaxKeysPolicy
+	background    bool
+	codec         Codec
+
+	chanSet           chan *reqSet
+	chanRenameNX      chan *reqRenameNX
+	chanDelTag        chan *reqDelTag
+	chanDelPattern    chan *reqDelPattern
+	chanCountPattern  chan *reqCountPattern
+	chanCountTag      chan *reqCountTag
+	chanExpireTag     chan *reqExpireTag
+	chanGet           chan *reqGet
+	chanGetSetEx      chan *reqGetSetEx
+	chanDel           chan *reqDel
+	chanUnlink        chan *reqUnlink
+	chanZAdd          chan *reqZAdd
+	chanZScore        chan *reqZScore
+	chanZRange        chan *reqZRange
+	chanZRangeByScore chan *reqZRangeByScore
+	chanSetBit        chan *reqSetBit
+	chanGetBit        chan *reqGetBit
+	chanBitCount      chan *reqBitCount
+	chanGetRange      chan *reqGetRange
+	chanPFAdd         chan *reqPFAdd
+	chanPFCount       chan *reqPFCount
+	chanTTLs          chan *reqTTLs
+	chanScan          chan *reqScan
+	chanPFMerge       chan *reqPFMerge
+	chanMemoryUsage   chan *reqMemoryUsage
+	chanSetIf         chan *reqSetIf
+	chanSetNE         chan *reqSetNE
+	chanIncrWithTTL   chan *reqIncrWithTTL
+	chanIncrCap       chan *reqIncrCap
+	chanDump          chan *reqDump
+	chanRestore       chan *reqRestore
+	chanObject        chan *reqObject
+	chanStats         chan *reqStats
+	done              chan struct{}
+}
+
+// New creates a Store and starts the goroutine serving it.
+func New() Store {
+	return NewWithBackend(nil)
+}
+
+// NewWithBackend creates a Store caching the backend and starts the goroutine
+// serving it. A nil backend makes it a standalone Store.
+func NewWithBackend(backend Backend) Store {
+	return NewWithOptions(Options{Backend: backend})
+}
+
+// NewWithOptions creates a Store configured by the options and starts the
+// goroutine serving it.
+func NewWithOptions(opts Options) Store {
+	s := &store{
+		backend:           opts.Backend,
+		checksums:         opts.Checksums,
+		maxKeys:           opts.MaxKeys,
+		maxKeysPolicy:     opts.MaxKeysPolicy,
+		background:        opts.BackgroundCompaction,
+		codec:             opts.Codec,
+		chanSet:           make(chan *reqSet),
+		chanRenameNX:      make(chan *reqRenameNX),
+		chanDelTag:        make(chan *reqDelTag),
+		chanDelPattern:    make(chan *reqDelPattern),
+		chanCountPattern:  make(chan *reqCountPattern),
+		chanCountTag:      make(chan *reqCountTag),
+		chanExpireTag:     make(chan *reqExpireTag),
+		chanGet:           make(chan *reqGet),
+		chanGetSetEx:      make(chan *reqGetSetEx),
+		chanDel:           make(chan *reqDel),
+		chanUnlink:        make(chan *reqUnlink),
+		chanZAdd:          make(chan *reqZAdd),
+		chanZScore:        make(chan *reqZScore),
+		chanZRange:        make(chan *reqZRange),
+		chanZRangeByScore: make(chan *reqZRangeByScore),
+		chanSetBit:        make(chan *reqSetBit),
+		chanGetBit:        make(chan *reqGetBit),
+		chanBitCount:      make(chan *reqBitCount),
+		chanGetRange:      make(chan *reqGetRange),
+		chanPFAdd:         make(chan *reqPFAdd),
+		chanPFCount:       make(chan *reqPFCount),
+		chanTTLs:          make(chan *reqTTLs),
+		chanScan:          make(chan *reqScan),
+		chanPFMerge:       make(chan *reqPFMerge),
+		chanMemoryUsage:   make(chan *reqMemoryUsage),
+		chanSetIf:         make(chan *reqSetIf),
+		chanSetNE:         make(chan *reqSetNE),
+		chanIncrWithTTL:   make(chan *reqIncrWithTTL),
+		chanIncrCap:       make(chan *reqIncrCap),
+		chanDump:          make(chan *reqDump),
+		chanRestore:       make(chan *reqRestore),
+		chanObject:        make(chan *reqObject),
+		chanStats:         make(chan *reqStats),
+		done:              make(chan struct{}),
+	}
+
+	go s.serve()
+
+	return s
+}
+
+func (s *store) Get(key string) (string, bool, error) {
+	req := &reqGet{
+		key:      key,
+		response: make(chan reqGetVal, 1),
+	}
+
+	s.chanGet <- req
+	resp := <-req.response
+
+	return resp.value, resp.ok, resp.err
+}
+
+func (s *store) GetUnsafe(key string) ([]byte, bool, error) {
+	req := &reqGet{
+		key:      key,
+		view:     true,
+		response: make(chan reqGetVal, 1),
+	}
+
+	s.chanGet <- req
+	resp := <-req.response
+
+	return resp.bytes, resp.ok, resp.err
+}
+
+func (s *store) GetChecksum(key string) (string, uint32, bool, error) {
+	req := &reqGet{
+		key:      key,
+		checksum: true,
+		response: make(chan reqGetVal, 1),
+	}
+
+	s.chanGet <- req
+	resp := <-req.response
+
+	return resp.value, resp.crc, resp.ok, resp.err
+}
+
+func (s *store) GetWithTTL(key string) (string, time.Duration, bool, error) {
+	req := &reqGet{
+		key:      key,
+		response: make(chan reqGetVal, 1),
+	}
+
+	s.chanGet <- req
+	resp := <-req.response
+
+	return resp.value, resp.ttl, resp.ok, resp.err
+}
+
+func (s *store) GetDefault(key, def string) (string, bool, error) {
+	req := &reqGet{
+		key:        key,
+		def:        def,
+		hasDefault: true,
+		response:   make(chan reqGetVal, 1),
+	}
+
+	s.chanGet <- req
+	resp := <-req.response
+
+	return resp.value, resp.ok, resp.err
+}
+
+func (s *store) Set(key, value string) error {
+	return s.SetTagged(key, value, "")
+}
+
+func (s *store) SetChanged(key, value, tag string) (bool, error) {
+	req := &reqSet{
+		key:      key,
+		value:    value,
+		tag:      tag,
+		compare:  true,
+		response: make(chan reqSetVal, 1),
+	}
+
+	s.chanSet <- req
+	resp := <-req.response
+
+	return resp.changed, resp.err
+}
+
+func (s *store) SetKeepTTL(key, value, tag string) (bool, error) {
+	req := &reqSet{
+		key:      key,
+		value:    value,
+		tag:      tag,
+		keepTTL:  true,
+		compare:  true,
+		response: make(chan reqSetVal, 1),
+	}
+
+	s.chanSet <- req
+	resp := <-req.response
+
+	return resp.changed, resp.err
+}
+
+func (s *store) RenameNX(src, dst string) (bool, bool) {
+	req := &reqRenameNX{
+		src:      src,
+		dst:      dst,
+		response: make(chan reqRenameNXVal, 1),
+	}
+
+	s.chanRenameNX <- req
+	resp := <-req.response
+
+	return resp.renamed, resp.ok
+}
+
+func (s *store) SetTagged(key, value, tag string) error {
+	req := &reqSet{
+		key:      key,
+		value:    value,
+		tag:      tag,
+		response: make(chan reqSetVal, 1),
+	}
+
+	s.chanSet <- req
+	resp := <-req.response
+
+	return resp.err
+}
+
+func (s *store) DelTag(tag string) int {
+	req := &reqDelTag{
+		tag:      tag,
+		response: make(chan int, 1),
+	}
+
+	s.chanDelTag <- req
+
+	return <-req.response
+}
+
+func (s *store) DelPattern(pattern string) (int, error) {
+	req := &reqDelPattern{
+		pattern:  pattern,
+		response: make(chan reqDelPatternVal, 1),
+	}
+
+	s.chanDelPattern <- req
+	resp := <-req.response
+
+	return resp.removed, resp.err
+}
+
+func (s *store) CountPattern(pattern string) (int, error) {
+	req := &reqCountPattern{
+		pattern:  pattern,
+		response: make(chan reqCountPatternVal, 1),
+	}
+
+	s.chanCountPattern <- req
+	resp := <-req.response
+
+	return resp.count, resp.err
+}
+
+func (s *store) CountTag(tag string) int {
+	req := &reqCountTag{
+		tag:      tag,
+		response: make(chan int, 1),
+	}
+
+	s.chanCountTag <- req
+
+	return <-req.response
+}
+
+func (s *store) ExpireTag(tag string, ttl time.Duration) int {
+	req := &reqExpireTag{
+		tag:      tag,
+		ttl:      ttl,
+		response: make(chan int, 1),
+	}
+
+	s.chanExpireTag <- req
+
+	return <-req.response
+}
+
+func (s *store) GetSetEx(key, value string, ttl time.Duration) (string, bool, error) {
+	req := &reqGetSetEx{
+		key:      key,
+		value:    value,
+		ttl:      ttl,
+		response: make(chan reqGetVal, 1),
+	}
+
+	s.chanGetSetEx <- req
+	resp := <-req.response
+
+	return resp.value, resp.ok, resp.err
+}
+
+func (s *store) Del(key string) bool {
+	req := &reqDel{
+		key:      key,
+		response: make(chan bool, 1),
+	}
+
+	s.chanDel <- req
+
+	return <-req.response
+}
+
+func (s *store) Unlink(key string) bool {
+	req := &reqUnlink{
+		key:      key,
+		response: make(chan bool, 1),
+	}
+
+	s.chanUnlink <- req
+
+	return <-req.response
+}
+
+func (s *store) ZAdd(key string, score float64, member string) (bool, error) {
+	req := &reqZAdd{
+		key:      key,
+		score:    score,
+		member:   member,
+		response: make(chan reqZAddVal, 1),
+	}
+
+	s.chanZAdd <- req
+
+	resp := <-req.response
+	return resp.changed, resp.err
+}
+
+func (s *store) ZScore(key, member string) (float64, bool, error) {
+	req := &reqZScore{
+		key:      key,
+		member:   member,
+		response: make(chan reqZScoreVal, 1),
+	}
+
+	s.chanZScore <- req
+	resp := <-req.response
+
+	return resp.score, resp.ok, resp.err
+}
+
+func (s *store) ZRange(key string, start, stop int) ([]ScoredMember, error) {
+	req := &reqZRange{
+		key:      key,
+		start:    start,
+		stop:     stop,
+		response: make(chan reqZRangeVal, 1),
+	}
+
+	s.chanZRange <- req
+	resp := <-req.response
+
+	return resp.members, resp.err
+}
+
+func (s *store) ZRangeByScore(key string, min, max ScoreBound, offset, count int) ([]ScoredMember, error) {
+	req := &reqZRangeByScore{
+		key:      key,
+		min:      min,
+		max:      max,
+		offset:   offset,
+		count:    count,
+		response: make(chan reqZRangeVal, 1),
+	}
+
+	s.chanZRangeByScore <- req
+	resp := <-req.response
+
+	return resp.members, resp.err
+}
+
+func (s *store) SetBit(key string, offset uint64, bit bool) (bool, error) {
+	req := &reqSetBit{
+		key:      key,
+		offset:   offset,
+		bit:      bit,
+		response: make(chan reqBitVal, 1),
+	}
+
+	s.chanSetBit <- req
+	resp := <-req.response
+
+	return resp.bit, resp.err
+}
+
+func (s *store) GetBit(key string, offset uint64) (bool, error) {
+	req := &reqGetBit{
+		key:      key,
+		offset:   offset,
+		response: make(chan reqBitVal, 1),
+	}
+
+	s.chanGetBit <- req
+	resp := <-req.response
+
+	return resp.bit, resp.err
+}
+
+func (s *store) BitCount(key string, start, end int) (int, error) {
+	req := &reqBitCount{
+		key:      key,
+		start:    start,
+		end:      end,
+		response: make(chan reqBitCountVal, 1),
+	}
+
+	s.chanBitCount <- req
+	resp := <-req.response
+
+	return resp.count, resp.err
+}
+
+func (s *store) GetRange(key string, start, end int) (string, bool, error) {
+	req := &reqGetRange{
+		key:      key,
+		start:    start,
+		end:      end,
+		response: make(chan reqGetVal, 1),
+	}
+
+	s.chanGetRange <- req
+	resp := <-req.response
+
+	return resp.value, resp.ok, resp.err
+}
+
+func (s *store) PFAdd(key string, elements []string) (bool, error) {
+	req := &reqPFAdd{
+		key:      key,
+		elements: elements,
+		response: make(chan reqPFAddVal, 1),
+	}
+
+	s.chanPFAdd <- req
+	resp := <-req.response
+
+	return resp.changed, resp.err
+}
+
+func (s *store) TTLs(keys []string) []time.Duration {
+	req := &reqTTLs{
+		keys:     keys,
+		response: make(chan []time.Duration, 1),
+	}
+
+	s.chanTTLs <- req
+
+	return <-req.response
+}
+
+func (s *store) Scan(prefix, after string, count int) ([]KeyValue, bool) {
+	req := &reqScan{
+		prefix:   prefix,
+		after:    after,
+		count:    count,
+		response: make(chan reqScanVal, 1),
+	}
+
+	s.chanScan <- req
+	resp := <-req.response
+
+	return resp.pairs, resp.more
+}
+
+func (s *store) PFCount(keys []string) (uint64, error) {
+	req := &reqPFCount{
+		keys:     keys,
+		response: make(chan reqPFCountVal, 1),
+	}
+
+	s.chanPFCount <- req
+	resp := <-req.response
+
+	return resp.count, resp.err
+}
+
+func (s *store) PFMerge(dest string, sources []string) error {
+	req := &reqPFMerge{
+		dest:     dest,
+		sources:  sources,
+		response: make(chan error, 1),
+	}
+
+	s.chanPFMerge <- req
+
+	return <-req.response
+}
+
+func (s *store) MemoryUsage(key string) (int, bool) {
+	req := &reqMemoryUsage{
+		key:      key,
+		response: make(chan reqMemoryUsageVal, 1),
+	}
+
+	s.chanMemoryUsage <- req
+	resp := <-req.response
+
+	return resp.bytes, resp.ok
+}
+
+func (s *store) SetIf(key string, cond Condition, operand, value string) (bool, error) {
+	req := &reqSetIf{
+		key:      key,
+		cond:     cond,
+		operand:  operand,
+		value:    value,
+		response: make(chan reqSetIfVal, 1),
+	}
+
+	s.chanSetIf <- req
+	resp := <-req.response
+
+	return resp.applied, resp.err
+}
+
+func (s *store) SetNE(key, value string) (bool, error) {
+	req := &reqSetNE{
+		key:      key,
+		value:    value,
+		response: make(chan reqSetVal, 1),
+	}
+
+	s.chanSetNE <- req
+	resp := <-req.response
+
+	return resp.changed, resp.err
+}
+
+func (s *store) IncrWithTTL(key string, ttl time.Duration) (int64, error) {
+	req := &reqIncrWithTTL{
+		key:      key,
+		ttl:      ttl,
+		response: make(chan reqIncrVal, 1),
+	}
+
+	s.chanIncrWithTTL <- req
+	resp := <-req.response
+
+	return resp.value, resp.err
+}
+
+func (s *store) IncrCap(key string, max int64) (int64, bool, error) {
+	req := &reqIncrCap{
+		key:      key,
+		max:      max,
+		response: make(chan reqIncrVal, 1),
+	}
+
+	s.chanIncrCap <- req
+	resp := <-req.response
+
+	return resp.value, resp.capped, resp.err
+}
+
+func (s *store) Dump(key string) ([]byte, bool) {
+	req := &reqDump{
+		key:      key,
+		response: make(chan reqDumpVal, 1),
+	}
+
+	s.chanDump <- req
+	resp := <-req.response
+
+	return resp.blob, resp.ok
+}
+
+func (s *store) Restore(key string, ttl time.Duration, blob []byte) error {
+	// the dump is decoded here to spare the goroutine serving the store
+	value, err := undump(blob)
+	if err != nil {
+		return err
+	}
+
+	req := &reqRestore{
+		key:      key,
+		ttl:      ttl,
+		value:    value,
+		response: make(chan error, 1),
+	}
+
+	s.chanRestore <- req
+
+	return <-req.response
+}
+
+func (s *store) Object(key string) (ObjectInfo, bool) {
+	req := &reqObject{
+		key:      key,
+		response: make(chan reqObjectVal, 1),
+	}
+
+	s.chanObject <- req
+	resp := <-req.response
+
+	return resp.info, resp.ok
+}
+
+func (s *store) Stats() Stats {
+	req := &reqStats{
+		response: make(chan Stats, 1),
+	}
+
+	s.chanStats <- req
+
+	return <-req.response
+}
+
+func (s *store) Close() {
+	close(s.done)
+}
+
+func (s *store) serve() {
+	storage := newKeyspace()
+	storage.checksums = s.checksums
+	storage.maxKeys = s.maxKeys
+	storage.evict = s.maxKeysPolicy == EvictLRU
+	storage.background = s.background
+	storage.codec = s.codec
+	storage.backend = s.backend
+
+	expireTicker := time.NewTicker(100 * time.Millisecond)
+	defer expireTicker.Stop()
+
+	for {
+		select {
+		case req := <-s.chanSet:
+			resp := reqSetVal{changed: true}
+			if resp.err = storage.admit(req.key); resp.err != nil {
+				resp.changed = false
+				req.response <- resp
+				break
+			}
+			if req.compare || req.keepTTL {
+				if b, ok, _ := bytesOf(storage, req.key); ok {
+					resp.changed = string(b) != req.value
+				}
+			}
+			// bytesOf removed the key if it expired, so an expiration time
+			// kept is in the future
+			at, expires := storage.expiration(req.key)
+			storage.set(req.key, []byte(req.value))
+			if req.keepTTL && expires {
+				storage.expireAt(req.key, at)
+			}
+			if req.tag != "" {
+				storage.tag(req.key, req.tag)
+			}
+			s.writeThrough(req.key, req.value)
+			req.response <- resp
+		case req := <-s.chanRenameNX:
+			resp := reqRenameNXVal{}
+			if resp.ok = s.load(storage, req.src); resp.ok {
+				if !s.exists(storage, req.dst) {
+					storage.rename(req.src, req.dst)
+					if b, ok, err := bytesOf(storage, req.dst); ok && err == nil {
+						s.writeThrough(req.dst, string(b))
+					}
+					resp.renamed = true
+				}
+			}
+			req.response <- resp
+		case req := <-s.chanDelTag:
+			removed := 0
+			for _, key := range storage.taggedKeys(req.tag) {
+				if _, ok := storage.del(key); ok {
+					removed++
+				}
+			}
+			req.response <- removed
+		case req := <-s.chanDelPattern:
+			resp := reqDelPatternVal{}
+			// matching the empty key validates the whole pattern upfront
+			if _, resp.err = path.Match(req.pattern, ""); resp.err == nil {
+				for _, key := range storage.keys() {
+					if matched, _ := path.Match(req.pattern, key); !matched {
+						continue
+					}
+					if _, ok := storage.del(key); ok {
+						resp.removed++
+					}
+				}
+			}
+			req.response <- resp
+		case req := <-s.chanCountPattern:
+			resp := reqCountPatternVal{}
+			if _, resp.err = path.Match(req.pattern, ""); resp.err == nil {
+				for _, key := range storage.keys() {
+					if matched, _ := path.Match(req.pattern, key); !matched {
+						continue
+					}
+					if _, ok := storage.peek(key); ok {
+						resp.count++
+					}
+				}
+			}
+			req.response <- resp
+		case req := <-s.chanCountTag:
+			count := 0
+			for _, key := range storage.taggedKeys(req.tag) {
+				if _, ok := storage.peek(key); ok {
+					count++
+				}
+			}
+			req.response <- count
+		case req := <-s.chanExpireTag:
+			expiring := 0
+			at := time.Now().Add(req.ttl)
+			for _, key := range storage.taggedKeys(req.tag) {
+				if _, ok := storage.peek(key); ok {
+					storage.expireAt(key, at)
+					expiring++
+				}
+			}
+			req.response <- expiring
+		case req := <-s.chanGet:
+			resp := reqGetVal{}
+			var b []byte
+			if b, resp.ok, resp.err = bytesOf(storage, req.key); resp.ok {
+				valid := true
+				if req.checksum || storage.checksums {
+					resp.crc, valid = storage.checksum(req.key, b)
+				}
+				switch {
+				case !valid:
+					resp.ok, resp.err = false, ErrChecksumMismatch
+				case req.view:
+					resp.bytes = b
+				default:
+					resp.value = string(b)
+				}
+			} else if resp.err == nil && s.backend != nil {
+				// a loaded value is returned but not cached if there is no
+				// room left for it
+				if resp.value, resp.ok = s.backend.Load(req.key); resp.ok && storage.admit(req.key) == nil {
+					storage.set(req.key, []byte(resp.value))
+				}
+				if resp.ok && req.checksum {
+					resp.crc = crc32.ChecksumIEEE([]byte(resp.value))
+				}
+				if resp.ok && req.view {
+					resp.bytes = []byte(resp.value)
+				}
+			}
+			if !resp.ok && resp.err == nil && req.hasDefault {
+				resp.value = req.def
+			}
+			if ttl, ok := storage.ttl(req.key); ok && resp.ok {
+				resp.ttl = ttl
+			} else {
+				resp.ttl = -1
+			}
+			req.response <- resp
+		case req := <-s.chanGetSetEx:
+			resp := reqGetVal{}
+			var b []byte
+			if resp.err = storage.admit(req.key); resp.err != nil {
+				req.response <- resp
+				break
+			}
+			if b, resp.ok, resp.err = bytesOf(storage, req.key); resp.err == nil {
+				resp.value = string(b)
+				storage.set(req.key, []byte(req.value))
+				storage.expireAt(req.key, time.Now().Add(req.ttl))
+				s.writeThrough(req.key, req.value)
+			}
+			req.response <- resp
+		case req := <-s.chanDel:
+			_, removed := storage.del(req.key)
+			req.response <- removed
+		case req := <-s.chanUnlink:
+			value, removed := storage.del(req.key)
+			if removed {
+				go release(value)
+			}
+			req.response <- removed
+		case req := <-s.chanZAdd:
+			resp := reqZAddVal{}
+			var z *sortedSet
+			if z, resp.err = sortedSetOf(storage, req.key, true); resp.err == nil {
+				resp.changed = z.add(req.score, req.member)
+			}
+			req.response <- resp
+		case req := <-s.chanZScore:
+			resp := reqZScoreVal{}
+			var z *sortedSet
+			if z, resp.err = sortedSetOf(storage, req.key, false); z != nil {
+				resp.score, resp.ok = z.scores[req.member]
+			}
+			req.response <- resp
+		case req := <-s.chanZRange:
+			resp := reqZRangeVal{}
+			var z *sortedSet
+			if z, resp.err = sortedSetOf(storage, req.key, false); z != nil {
+				resp.members = z.rangeByIndex(req.start, req.stop)
+			}
+			req.response <- resp
+		case req := <-s.chanZRangeByScore:
+			resp := reqZRangeVal{}
+			var z *sortedSet
+			if z, resp.err = sortedSetOf(storage, req.key, false); z != nil {
+				resp.members = z.rangeByScore(req.min, req.max, req.offset, req.count)
+			}
+			req.response <- resp
+		case req := <-s.chanSetBit:
+			resp := reqBitVal{}
+			var b []byte
+			if resp.err = storage.admit(req.key); resp.err != nil {
+				req.response <- resp
+				break
+			}
+			if b, _, resp.err = bytesOf(storage, req.key); resp.err == nil {
+				b, resp.bit = setBit(b, req.offset, req.bit)
+				storage.put(req.key, b)
+			}
+			req.response <- resp
+		case req := <-s.chanGetBit:
+			resp := reqBitVal{}
+			var b []byte
+			if b, _, resp.err = bytesOf(storage, req.key); resp.err == nil {
+				resp.bit = getBit(b, req.offset)
+			}
+			req.response <- resp
+		case req := <-s.chanBitCount:
+			resp := reqBitCountVal{}
+			var b []byte
+			if b, _, resp.err = bytesOf(storage, req.key); resp.err == nil {
+				resp.count = bitCount(b, req.start, req.end)
+			}
+			req.response <- resp
+		case req := <-s.chanGetRange:
+			resp := reqGetVal{}
+			var b []byte
+			if b, resp.ok, resp.err = bytesOf(storage, req.key); resp.ok {
+				valid := true
+				if storage.checksums {
+					_, valid = storage.checksum(req.key, b)
+				}
+				if valid {
+					from, to := normalizeRange(req.start, req.end, len(b))
+					resp.value = string(b[from:to])
+				} else {
+					resp.ok, resp.err = false, ErrChecksumMismatch
+				}
+			}
+			req.response <- resp
+		case req := <-s.chanPFAdd:
+			resp := reqPFAddVal{}
+			var h *hyperLogLog
+			if h, resp.err = hyperLogLogOf(storage, req.key, true); h != nil {
+				for _, element := range req.elements {
+					if h.add(element) {
+						resp.changed = true
+					}
+				}
+			}
+			req.response <- resp
+		case req := <-s.chanPFCount:
+			resp := reqPFCountVal{}
+			union := &hyperLogLog{}
+			for _, key := range req.keys {
+				var h *hyperLogLog
+				if h, resp.err = hyperLogLogOf(storage, key, false); resp.err != nil {
+					break
+				}
+				if h != nil {
+					union.merge(h)
+				}
+			}
+			if resp.err == nil {
+				resp.count = union.count()
+			}
+			req.response <- resp
+		case req := <-s.chanTTLs:
+			ttls := make([]time.Duration, len(req.keys))
+			for i, key := range req.keys {
+				if _, ok := storage.peek(key); !ok {
+					ttls[i] = MissingTTL
+				} else if ttl, ok := storage.ttl(key); ok {
+					ttls[i] = ttl
+				} else {
+					ttls[i] = NoTTL
+				}
+			}
+			req.response <- ttls
+		case req := <-s.chanScan:
+			resp := reqScanVal{}
+			if req.count <= 0 {
+				req.response <- resp
+				break
+			}
+			// one more key than asked for tells whether keys are left, the
+			// count is bounded by the number of keys so that it can't
+			// overflow
+			count := min(req.count, storage.len())
+			keys := storage.scan(req.prefix, req.after, count+1)
+			if len(keys) > count {
+				keys, resp.more = keys[:count], true
+			}
+			resp.pairs = make([]KeyValue, 0, len(keys))
+			for _, key := range keys {
+				// keys whose string is corrupt are skipped, reading them
+				// reports the error
+				if b, ok, err := bytesOf(storage, key); ok && err == nil {
+					resp.pairs = append(resp.pairs, KeyValue{Key: key, Value: string(b)})
+				}
+			}
+			req.response <- resp
+		case req := <-s.chanPFMerge:
+			req.response <- pfMerge(storage, req.dest, req.sources)
+		case req := <-s.chanMemoryUsage:
+			resp := reqMemoryUsageVal{}
+			var e entry
+			if e, resp.ok = storage.peek(req.key); resp.ok {
+				resp.bytes = memoryUsage(req.key, e.value)
+			}
+			req.response <- resp
+		case req := <-s.chanSetIf:
+			resp := reqSetIfVal{}
+			b, ok, err := bytesOf(storage, req.key)
+			if ok {
+				resp.applied, err = req.cond.holds(b, req.operand)
+			}
+			resp.err = err
+			if resp.applied {
+				storage.put(req.key, []byte(req.value))
+				s.writeThrough(req.key, req.value)
+			}
+			req.response <- resp
+		case req := <-s.chanSetNE:
+			resp := reqSetVal{}
+			b, ok, _ := bytesOf(storage, req.key)
+			if ok && string(b) == req.value {
+				req.response <- resp
+				break
+			}
+			if resp.err = storage.admit(req.key); resp.err == nil {
+				storage.set(req.key, []byte(req.value))
+				s.writeThrough(req.key, req.value)
+				resp.changed = true
+			}
+			req.response <- resp
+		case req := <-s.chanIncrWithTTL:
+			resp := reqIncrVal{}
+			var b []byte
+			var ok bool
+			if resp.err = storage.admit(req.key); resp.err != nil {
+				req.response <- resp
+				break
+			}
+			if b, ok, resp.err = bytesOf(storage, req.key); resp.err == nil {
+				if resp.value, resp.err = increment(b, ok, 1); resp.err == nil {
+					value := strconv.FormatInt(resp.value, 10)
+					storage.put(req.key, []byte(value))
+					if !ok {
+						storage.expireAt(req.key, time.Now().Add(req.ttl))
+					}
+					s.writeThrough(req.key, value)
+				}
+			}
+			req.response <- resp
+		case req := <-s.chanIncrCap:
+			resp := reqIncrVal{}
+			var b []byte
+			var ok bool
+			var n int64
+			if resp.err = storage.admit(req.key); resp.err != nil {
+				req.response <- resp
+				break
+			}
+			if b, ok, resp.err = bytesOf(storage, req.key); resp.err == nil {
+				n, resp.err = increment(b, ok, 0)
+			}
+			switch {
+			case resp.err != nil:
+			case n >= req.max:
+				// a value already above max, such as one set before the
+				// ceiling was lowered, isn't lowered to it
+				resp.value, resp.capped = n, true
+			default:
+				resp.value = n + 1
+				value := strconv.FormatInt(resp.value, 10)
+				storage.put(req.key, []byte(value))
+				s.writeThrough(req.key, value)
+			}
+			req.response <- resp
+		case req := <-s.chanDump:
+			resp := reqDumpVal{}
+			var value interface{}
+			if value, resp.ok = storage.get(req.key); resp.ok {
+				// dumps hold decoded strings so that they can be restored
+				// whatever the codec, a corrupt string can't be dumped
+				if value, err := storage.decoded(value); err == nil {
+					resp.blob = dump(value)
+				} else {
+					resp.ok = false
+				}
+			}
+			req.response <- resp
+		case req := <-s.chanRestore:
+			if _, ok := storage.get(req.key); ok {
+				req.response <- ErrKeyExists
+				break
+			}
+			if err := storage.admit(req.key); err != nil {
+				req.response <- err
+				break
+			}
+			storage.set(req.key, req.value)
+			if req.ttl > 0 {
+				storage.expireAt(req.key, time.Now().Add(req.ttl))
+			}
+			req.response <- nil
+		case req := <-s.chanObject:
+			resp := reqObjectVal{}
+			var e entry
+			if e, resp.ok = storage.peek(req.key); resp.ok {
+				resp.info = describe(req.key, e, storage)
+				resp.info.TTL, resp.info.HasTTL = storage.ttl(req.key)
+			}
+			req.response <- resp
+		case req := <-s.chanStats:
+			req.response <- Stats{
+				Keys:           storage.len(),
+				Compactions:    storage.compactions,
+				CompactionTime: storage.compactionTime,
+				Evictions:      storage.evictions,
+				Expirations:    storage.expirations,
+				Deletions:      storage.deletions,
+			}
+		case <-expireTicker.C:
+			storage.expireSample()
+		case maps := <-storage.rebuilt:
+			storage.finishCompaction(maps)
+		case <-s.done:
+			return
+		}
+
+		storage.compact()
+	}
+}
+
+// describe describes the entry stored under the key in the keyspace, except
+// for its expiration time which is kept by the keyspace.
+func describe(key string, e entry, storage *keyspace) ObjectInfo {
+	info := ObjectInfo{
+		Idle:   time.Since(e.accessed),
+		Memory: memoryUsage(key, e.value),
+	}
+
+	switch v := e.value.(type) {
+	case []byte:
+		info.Type, info.Encoding = "string", "raw"
+		if b, err := storage.decoded(v); err == nil {
+			if _, err := strconv.ParseInt(string(b.([]byte)), 10, 64); err == nil {
+				info.Encoding = "int"
+			}
+		}
+	case *sortedSet:
+		info.Type, info.Encoding = "zset", "sortedslice"
+	case *hyperLogLog:
+		info.Type, info.Encoding = "hyperloglog", "dense"
+	}
+
+	return info
+}
+
+// load reports whether the key exists, loading it from the backend if the
+// store has one and the key is missing from the storage.
+func (s *store) load(storage *keyspace, key string) bool {
+	if _, ok := storage.get(key); ok {
+		return true
+	}
+	if s.backend == nil {
+		return false
+	}
+
+	value, ok := s.backend.Load(key)
+	if !ok || storage.admit(key) != nil {
+		return false
+	}
+	storage.set(key, []byte(value))
+
+	return true
+}
+
+// exists reports whether the key exists, in the storage or in the backend if
+// the store has one, without loading it.
+func (s *store) exists(storage *keyspace, key string) bool {
+	if _, ok := storage.peek(key); ok {
+		return true
+	}
+	if s.backend == nil {
+		return false
+	}
+
+	_, ok := s.backend.Load(key)
+
+	return ok
+}
+
+// writeThrough stores the string in the backend if the store has one.
+func (s *store) writeThrough(key, value string) {
+	if s.backend != nil {
+		s.backend.Store(key, value)
+	}
+}
+
+// increment adds delta to the integer stored as b, a missing value counts as
+// zero.
+func increment(b []byte, found bool, delta int64) (int64, error) {
+	var n int64
+	if found {
+		var err error
+		if n, err = strconv.ParseInt(string(b), 10, 64); err != nil {
+			return 0, ErrNotInteger
+		}
+	}
+
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, ErrOverflow
+	}
+
+	return n + delta, nil
+}
+
+// bytesOf returns the string stored under the key, ok reports whether the key
+// was found.
+func bytesOf(storage *keyspace, key string) ([]byte, bool, error) {
+	value, ok := storage.get(key)
+	if !ok {
+		return nil, false, nil
+	}
+
+	if _, ok := value.([]byte); !ok {
+		return nil, false, ErrWrongType
+	}
+
+	value, err := storage.decoded(value)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return value.([]byte), true, nil
+}
+
+// sortedSetOf returns the sorted set stored under the key. A missing key yields
+// a nil set, or a new empty set stored under the key if create is set.
+func sortedSetOf(storage *keyspace, key string, create bool) (*sortedSet, error) {
+	value, ok := storage.get(key)
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+
+		if err := storage.admit(key); err != nil {
+			return nil, err
+		}
+
+		z := newSortedSet()
+		storage.put(key, z)
+
+		return z, nil
+	}
+
+	z, ok := value.(*sortedSet)
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	return z, nil
+}
+
+// hyperLogLogOf returns the HyperLogLog stored under the key. A missing key
+// yields a nil HyperLogLog, or a new empty one stored under the key if create
+// is set.
+func hyperLogLogOf(storage *keyspace, key string, create bool) (*hyperLogLog, error) {
+	value, ok := storage.get(key)
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+
+		if err := storage.admit(key); err != nil {
+			return nil, err
+		}
+
+		h := &hyperLogLog{}
+		storage.put(key, h)
+
+		return h, nil
+	}
+
+	h, ok := value.(*hyperLogLog)
+	if !ok {
+		return nil, ErrWrongType
+	}
+
+	return h, nil
+}
+
+func pfMerge(storage *keyspace, dest string, sources []string) error {
+	// validate every key before touching the destination so that a wrong
+	// type leaves it unmodified
+	hs := make([]*hyperLogLog, 0, len(sources))
+	for _, key := range sources {
+		h, err := hyperLogLogOf(storage, key, false)
+		if err != nil {
+			return err
+		}
+		if h != nil {
+			hs = append(hs, h)
+		}
+	}
+	if _, err := hyperLogLogOf(storage, dest, false); err != nil {
+		return err
+	}
+
+	union, err := hyperLogLogOf(storage, dest, true)
+	if err != nil {
+		return err
+	}
+	for _, h := range hs {
+		union.merge(h)
+	}
+
+	return nil
+}
+
+// release drops a value detached from the storage by unlink. It runs on its own
+// goroutine so that tearing down a large value never stalls the storage, plain
+// strings have nothing to tear down and are left to the garbage collector.
+func release(value interface{}) {
+	switch v := value.(type) {
+	case *sortedSet:
+		for member := range v.scores {
+			delete(v.scores, member)
+		}
+		v.members = nil
+	}
+}
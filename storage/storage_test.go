@@ -0,0 +1,276 @@
+package storage
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestStalledRequesterDoesNotBlockOthers checks that a requester which never
+// reads its responses doesn't keep the goroutine serving the store from
+// serving other requesters.
+func TestStalledRequesterDoesNotBlockOthers(t *testing.T) {
+	s := New().(*store)
+	defer s.Close()
+
+	if err := s.Set("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stalled requester sends its request but never receives the
+	// response
+	s.chanGet <- &reqGet{key: "k", response: make(chan reqGetVal, 1)}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		value, ok, err := s.Get("k")
+		if err != nil || !ok || value != "v" {
+			t.Errorf("Get returned %q, %v, %v, want \"v\", true, nil", value, ok, err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Get blocked behind a requester not reading its responses")
+	}
+}
+
+func TestScanCounts(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := s.Set(key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		count int
+		keys  int
+		more  bool
+	}{
+		{-1, 0, false},
+		{0, 0, false},
+		{2, 2, true},
+		{3, 3, false},
+		{math.MaxInt, 3, false},
+	}
+
+	for _, test := range tests {
+		pairs, more := s.Scan("", "", test.count)
+		if len(pairs) != test.keys || more != test.more {
+			t.Errorf("Scan with count %d returned %d keys, more %v, want %d keys, more %v", test.count, len(pairs), more, test.keys, test.more)
+		}
+	}
+}
+
+// mapBackend is a Backend keeping the keys in a map.
+type mapBackend struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func newMapBackend() *mapBackend {
+	return &mapBackend{values: make(map[string]string)}
+}
+
+func (b *mapBackend) Load(key string) (string, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	value, ok := b.values[key]
+	return value, ok
+}
+
+func (b *mapBackend) Store(key, value string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.values[key] = value
+}
+
+func (b *mapBackend) Delete(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.values, key)
+}
+
+// TestBackendDeletes checks that the keys removed from a Store aren't loaded
+// back from its Backend, except for the keys evicted to make room.
+func TestBackendDeletes(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(s Store, key string)
+		loaded bool
+	}{
+		{"del", func(s Store, key string) { s.Del(key) }, false},
+		{"unlink", func(s Store, key string) { s.Unlink(key) }, false},
+		{"deltag", func(s Store, key string) { s.DelTag("tag") }, false},
+		{"delpattern", func(s Store, key string) { s.DelPattern("k*") }, false},
+		{"expire", func(s Store, key string) {
+			s.ExpireTag("tag", time.Millisecond)
+			time.Sleep(10 * time.Millisecond)
+		}, false},
+		{"evict", func(s Store, key string) { s.Set("other", "v") }, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newMapBackend()
+			s := NewWithOptions(Options{Backend: backend, MaxKeys: 1, MaxKeysPolicy: EvictLRU})
+			defer s.Close()
+
+			if err := s.SetTagged("k", "v", "tag"); err != nil {
+				t.Fatal(err)
+			}
+			test.remove(s, "k")
+
+			_, ok, err := s.Get("k")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != test.loaded {
+				t.Errorf("Get found the key: %v, want %v", ok, test.loaded)
+			}
+		})
+	}
+}
+
+// TestBackendDeletesKeysNotLoaded checks that deleting a key the Store hasn't
+// loaded from its Backend yet deletes it from the Backend.
+func TestBackendDeletesKeysNotLoaded(t *testing.T) {
+	backend := newMapBackend()
+	backend.Store("k", "v")
+
+	s := NewWithBackend(backend)
+	defer s.Close()
+
+	s.Del("k")
+
+	if _, ok := backend.Load("k"); ok {
+		t.Error("the key is still in the backend")
+	}
+}
+
+// TestBackendRenameNX checks that renamenx moves the key in the Backend too,
+// and doesn't overwrite a key only the Backend holds.
+func TestBackendRenameNX(t *testing.T) {
+	backend := newMapBackend()
+	s := NewWithBackend(backend)
+	defer s.Close()
+
+	if err := s.Set("src", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if renamed, ok := s.RenameNX("src", "dst"); !renamed || !ok {
+		t.Fatalf("RenameNX returned %v, %v, want true, true", renamed, ok)
+	}
+	if _, ok, _ := s.Get("src"); ok {
+		t.Error("src was loaded back from the backend")
+	}
+	if value, ok := backend.Load("dst"); !ok || value != "v" {
+		t.Errorf("backend holds %q, %v under dst, want \"v\", true", value, ok)
+	}
+
+	backend.Store("taken", "persisted")
+	if renamed, ok := s.RenameNX("dst", "taken"); renamed || !ok {
+		t.Fatalf("RenameNX onto a key of the backend returned %v, %v, want false, true", renamed, ok)
+	}
+	if value, _ := backend.Load("taken"); value != "persisted" {
+		t.Errorf("backend holds %q under taken, want \"persisted\"", value)
+	}
+}
+
+// TestZAddChanged checks that ZAdd reports a change for new members and
+// updated scores only.
+func TestZAddChanged(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	steps := []struct {
+		score   float64
+		member  string
+		changed bool
+	}{
+		{1, "a", true},
+		{1, "a", false},
+		{2, "a", true},
+		{2, "b", true},
+		{2, "b", false},
+	}
+
+	for _, step := range steps {
+		changed, err := s.ZAdd("z", step.score, step.member)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != step.changed {
+			t.Errorf("ZAdd(%v, %s) reported %v, want %v", step.score, step.member, changed, step.changed)
+		}
+	}
+}
+
+// TestIncrCap checks that IncrCap increments up to max and leaves alone a
+// value already above it.
+func TestIncrCap(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	steps := []struct {
+		max    int64
+		value  int64
+		capped bool
+	}{
+		{2, 1, false},
+		{2, 2, false},
+		{2, 2, true},
+		{5, 3, false},
+		{1, 3, true},
+	}
+
+	for _, step := range steps {
+		value, capped, err := s.IncrCap("k", step.max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != step.value || capped != step.capped {
+			t.Errorf("IncrCap(%d) = %d, %v, want %d, %v", step.max, value, capped, step.value, step.capped)
+		}
+	}
+
+	if value, _, _ := s.Get("k"); value != "3" {
+		t.Errorf("k holds %q after IncrCap, want 3", value)
+	}
+}
+
+// TestCountPattern checks that CountPattern counts the keys DelPattern
+// removes, without removing them.
+func TestCountPattern(t *testing.T) {
+	s := New()
+	defer s.Close()
+
+	for _, key := range []string{"a:1", "a:2", "a:3", "b:1"} {
+		s.Set(key, "v")
+	}
+
+	count, err := s.CountPattern("a:*")
+	if err != nil || count != 3 {
+		t.Fatalf("CountPattern returned %d, %v, want 3", count, err)
+	}
+	if keys := s.Stats().Keys; keys != 4 {
+		t.Fatalf("%d keys are left after CountPattern, want 4", keys)
+	}
+	if removed, err := s.DelPattern("a:*"); err != nil || removed != count {
+		t.Fatalf("DelPattern returned %d, %v, want %d", removed, err, count)
+	}
+
+	if _, err := s.CountPattern("["); err == nil {
+		t.Fatal("CountPattern accepted a malformed pattern")
+	}
+}
@@ -0,0 +1,131 @@
+package storage
+
+import "sort"
+
+// ScoredMember is a member of a sorted set along with its score.
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+// sortedSet keeps members ordered by score, members with equal scores are
+// ordered lexicographically.
+type sortedSet struct {
+	scores  map[string]float64
+	members []ScoredMember
+}
+
+func newSortedSet() *sortedSet {
+	return &sortedSet{
+		scores: make(map[string]float64),
+	}
+}
+
+// search returns the position of the member with the given score in the
+// ordered slice, or the position it would be inserted at.
+func (z *sortedSet) search(score float64, member string) int {
+	return sort.Search(len(z.members), func(i int) bool {
+		m := z.members[i]
+		return m.Score > score || (m.Score == score && m.Member >= member)
+	})
+}
+
+// index returns the position of the member in the ordered slice, -1 if it
+// isn't there. The member is searched by its score, then scanned for in case
+// the score doesn't order it, as NaN doesn't.
+func (z *sortedSet) index(score float64, member string) int {
+	if i := z.search(score, member); i < len(z.members) && z.members[i].Member == member {
+		return i
+	}
+
+	for i, m := range z.members {
+		if m.Member == member {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// add inserts the member or updates its score, and reports whether the set
+// changed, that is whether the member is new or its score differs.
+func (z *sortedSet) add(score float64, member string) bool {
+	old, exists := z.scores[member]
+	if exists {
+		if old == score {
+			return false
+		}
+
+		if i := z.index(old, member); i >= 0 {
+			z.members = append(z.members[:i], z.members[i+1:]...)
+		}
+	}
+
+	z.scores[member] = score
+
+	i := z.search(score, member)
+	z.members = append(z.members, ScoredMember{})
+	copy(z.members[i+1:], z.members[i:])
+	z.members[i] = ScoredMember{member, score}
+
+	return true
+}
+
+// rangeByIndex returns members between start and stop, see normalizeRange.
+func (z *sortedSet) rangeByIndex(start, stop int) []ScoredMember {
+	from, to := normalizeRange(start, stop, len(z.members))
+	if from == to {
+		return nil
+	}
+
+	result := make([]ScoredMember, to-from)
+	copy(result, z.members[from:to])
+
+	return result
+}
+
+// ScoreBound is a bound of a score range, Exclusive bounds don't match the
+// value itself.
+type ScoreBound struct {
+	Value     float64
+	Exclusive bool
+}
+
+// rangeByScore returns members with scores between min and max in ascending
+// order. The first offset matching members are skipped, and at most count
+// members are returned unless count is negative.
+func (z *sortedSet) rangeByScore(min, max ScoreBound, offset, count int) []ScoredMember {
+	start := sort.Search(len(z.members), func(i int) bool {
+		if min.Exclusive {
+			return z.members[i].Score > min.Value
+		}
+		return z.members[i].Score >= min.Value
+	})
+	end := sort.Search(len(z.members), func(i int) bool {
+		if max.Exclusive {
+			return z.members[i].Score >= max.Value
+		}
+		return z.members[i].Score > max.Value
+	})
+
+	// offset and count may be large enough to overflow when added to the
+	// indexes, so they are compared to the number of members in range
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= end-start {
+		return nil
+	}
+	start += offset
+	if count >= 0 && count < end-start {
+		end = start + count
+	}
+	if start >= end {
+		return nil
+	}
+
+	result := make([]ScoredMember, end-start)
+	copy(result, z.members[start:end])
+
+	return result
+}
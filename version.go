@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.gitCommit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	version   = "dev"
+	gitCommit = "unknown"
+	buildDate = "unknown"
+)
+
+// buildInfo reports the build information as 'name:value' lines.
+func buildInfo() string {
+	lines := []string{
+		fmt.Sprintf("version:%s", version),
+		fmt.Sprintf("git_commit:%s", gitCommit),
+		fmt.Sprintf("build_date:%s", buildDate),
+	}
+
+	return strings.Join(lines, "\n")
+}